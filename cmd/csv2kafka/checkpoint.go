@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// fileIdentity identifies an input file well enough to tell whether a file
+// found after a restart is the one a checkpoint was taken for.
+type fileIdentity struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum"`
+}
+
+func (id fileIdentity) equal(other fileIdentity) bool {
+	return id.Name == other.Name &&
+		id.Size == other.Size &&
+		id.ModTime.Equal(other.ModTime) &&
+		id.Checksum == other.Checksum
+}
+
+// checkpoint records how many records of a file have been acknowledged, how
+// many of those were rejected and how many were detail rows. Done marks a
+// file that has been read and left in place.
+type checkpoint struct {
+	fileIdentity
+	Line     int  `json:"line"`
+	Rejected int  `json:"rejected,omitempty"`
+	Details  int  `json:"details,omitempty"`
+	Done     bool `json:"done,omitempty"`
+}
+
+// checkpointStore durably keeps the checkpoints of the files being read,
+// keyed by file name.
+type checkpointStore interface {
+	// Load returns the checkpoint for name, or nil if there is none.
+	Load(name string) (*checkpoint, error)
+	Save(cp *checkpoint) error
+	Delete(name string) error
+	Close() error
+}
+
+// newCheckpointStore returns the store selected by the checkpoint_store
+// setting, or nil if checkpointing is disabled. With a transactional writer
+// checkpoints always go to Kafka, in the writer's transactions.
+func newCheckpointStore(cfg *config, writer *KafkaWriter) (checkpointStore, error) {
+	if writer != nil && writer.transactional {
+		if cfg.CheckpointStore != "" && cfg.CheckpointStore != "kafka" {
+			return nil, fmt.Errorf("transactional_id requires the kafka checkpoint store")
+		}
+		return newKafkaCheckpointStore(cfg.KafkaBrokers, cfg.CheckpointTopic, writer)
+	}
+	switch cfg.CheckpointStore {
+	case "":
+		return nil, nil
+	case "file":
+		return newFileCheckpointStore(cfg.CheckpointFile)
+	case "kafka":
+		return newKafkaCheckpointStore(cfg.KafkaBrokers, cfg.CheckpointTopic, nil)
+	}
+	return nil, fmt.Errorf("unknown checkpoint store %q", cfg.CheckpointStore)
+}
+
+// fileCheckpointStore keeps checkpoints in a local JSON file, which is
+// rewritten atomically on every change.
+type fileCheckpointStore struct {
+	mu          sync.Mutex
+	path        string
+	checkpoints map[string]*checkpoint
+}
+
+func newFileCheckpointStore(path string) (*fileCheckpointStore, error) {
+	s := &fileCheckpointStore{path: path, checkpoints: make(map[string]*checkpoint)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &s.checkpoints); err != nil {
+		return nil, fmt.Errorf("checkpoint file %v: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *fileCheckpointStore) Load(name string) (*checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[name], nil
+}
+
+func (s *fileCheckpointStore) Save(cp *checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[cp.Name] = cp
+	return s.write()
+}
+
+func (s *fileCheckpointStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.checkpoints[name]; !ok {
+		return nil
+	}
+	delete(s.checkpoints, name)
+	return s.write()
+}
+
+func (s *fileCheckpointStore) Close() error {
+	return nil
+}
+
+func (s *fileCheckpointStore) write() error {
+	content, err := json.MarshalIndent(s.checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, content)
+}
+
+// writeFileAtomic replaces the file at path with content, so that a crash
+// leaves either the old or the new content behind.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// kafkaCheckpointStore keeps checkpoints in a compacted Kafka topic, keyed
+// by file name, with deletions written as tombstones. The topic is read
+// into memory on startup.
+//
+// Given a transactional writer, checkpoints are written in the writer's
+// current transaction, which is then committed. The records published since
+// the previous checkpoint thus become visible to read_committed consumers
+// together with the checkpoint that covers them.
+type kafkaCheckpointStore struct {
+	topic       string
+	producer    *kafka.Producer
+	delivery    chan kafka.Event
+	txn         *KafkaWriter
+	mu          sync.Mutex
+	checkpoints map[string]*checkpoint
+}
+
+const kafkaTimeoutMs = 10000
+
+func newKafkaCheckpointStore(brokers, topic string, txn *KafkaWriter) (*kafkaCheckpointStore, error) {
+	if err := createCompactedTopic(brokers, topic); err != nil {
+		return nil, err
+	}
+	checkpoints, err := loadKafkaCheckpoints(brokers, topic)
+	if err != nil {
+		return nil, err
+	}
+	s := &kafkaCheckpointStore{
+		topic:       topic,
+		delivery:    make(chan kafka.Event),
+		txn:         txn,
+		checkpoints: checkpoints,
+	}
+	if txn != nil {
+		s.producer = txn.writer
+		return s, nil
+	}
+	s.producer, err = kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": brokers})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func createCompactedTopic(brokers, topic string) error {
+	admin, err := kafka.NewAdminClient(&kafka.ConfigMap{"bootstrap.servers": brokers})
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeoutMs*time.Millisecond)
+	defer cancel()
+	results, err := admin.CreateTopics(ctx, []kafka.TopicSpecification{{
+		Topic:         topic,
+		NumPartitions: 1,
+		Config:        map[string]string{"cleanup.policy": "compact"},
+	}})
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if code := r.Error.Code(); code != kafka.ErrNoError && code != kafka.ErrTopicAlreadyExists {
+			return fmt.Errorf("creating topic %v: %v", topic, r.Error)
+		}
+	}
+	return nil
+}
+
+// loadKafkaCheckpoints reads the checkpoint topic from the beginning up to
+// its current end.
+func loadKafkaCheckpoints(brokers, topic string) (map[string]*checkpoint, error) {
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  brokers,
+		"group.id":           "csv2kafka-checkpoints",
+		"enable.auto.commit": false,
+		"isolation.level":    "read_committed",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	md, err := c.GetMetadata(&topic, false, kafkaTimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	var assignment []kafka.TopicPartition
+	remaining := make(map[int32]int64)
+	for _, p := range md.Topics[topic].Partitions {
+		low, high, err := c.QueryWatermarkOffsets(topic, p.ID, kafkaTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+		if high > low {
+			assignment = append(assignment, kafka.TopicPartition{
+				Topic:     &topic,
+				Partition: p.ID,
+				Offset:    kafka.OffsetBeginning,
+			})
+			remaining[p.ID] = high
+		}
+	}
+	checkpoints := make(map[string]*checkpoint)
+	if len(assignment) == 0 {
+		return checkpoints, nil
+	}
+	if err := c.Assign(assignment); err != nil {
+		return nil, err
+	}
+	for len(remaining) > 0 {
+		msg, err := c.ReadMessage(kafkaTimeoutMs * time.Millisecond)
+		if err != nil {
+			if kerr, ok := err.(kafka.Error); ok && kerr.Code() == kafka.ErrTimedOut {
+				// Transaction markers occupy offsets without
+				// being delivered, so the high watermark may
+				// never be reached exactly.
+				break
+			}
+			return nil, err
+		}
+		p := msg.TopicPartition.Partition
+		if msg.TopicPartition.Offset >= kafka.Offset(remaining[p]-1) {
+			delete(remaining, p)
+		}
+		name := string(msg.Key)
+		if msg.Value == nil {
+			delete(checkpoints, name)
+			continue
+		}
+		cp := &checkpoint{}
+		if err := json.Unmarshal(msg.Value, cp); err != nil {
+			return nil, fmt.Errorf("checkpoint for %v: %v", name, err)
+		}
+		checkpoints[name] = cp
+	}
+	return checkpoints, nil
+}
+
+func (s *kafkaCheckpointStore) Load(name string) (*checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[name], nil
+}
+
+func (s *kafkaCheckpointStore) Save(cp *checkpoint) error {
+	value, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := s.produce(cp.Name, value); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.checkpoints[cp.Name] = cp
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *kafkaCheckpointStore) Delete(name string) error {
+	s.mu.Lock()
+	_, ok := s.checkpoints[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := s.produce(name, nil); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.checkpoints, name)
+	s.mu.Unlock()
+	return nil
+}
+
+// Close closes the store's producer, unless it is the transactional
+// writer's.
+func (s *kafkaCheckpointStore) Close() error {
+	if s.txn == nil {
+		s.producer.Close()
+	}
+	return nil
+}
+
+func (s *kafkaCheckpointStore) produce(key string, value []byte) error {
+	m := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &s.topic, Partition: kafka.PartitionAny},
+		Key:            []byte(key),
+		Value:          value,
+	}
+	if s.txn != nil {
+		if err := s.txn.produce(m); err != nil {
+			return s.abort(err)
+		}
+		if err := s.txn.Commit(); err != nil {
+			return s.abort(err)
+		}
+		return nil
+	}
+	err := s.producer.Produce(m, s.delivery)
+	if err != nil {
+		return err
+	}
+	e := <-s.delivery
+	m = e.(*kafka.Message)
+	return m.TopicPartition.Error
+}
+
+// abort gives up on a transaction whose checkpoint could not be committed.
+// The rows read since the previous checkpoint are in the transaction, so
+// the writer stops, for the source to stop and read them again from there.
+func (s *kafkaCheckpointStore) abort(err error) error {
+	return s.txn.fail(fmt.Errorf("failed to commit checkpoint: %v", err))
+}
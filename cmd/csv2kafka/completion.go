@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// completion decides which of the files found in the input dir have been
+// completely written and may be read. Files still being uploaded are left
+// for a later scan.
+type completion struct {
+	// ignore lists glob patterns of upload temporary names.
+	ignore []string
+	// minAge is how long ago a file must have last been modified.
+	minAge time.Duration
+	// stable requires a file to have kept the same size and modification
+	// time for stableFor, as seen by the scans since.
+	stable    bool
+	stableFor time.Duration
+	seen      map[string]sighting
+	// markers lists suffixes of companion files, one of which must exist
+	// for a file to be complete. The marker is removed once the file has
+	// been moved out of the input dir.
+	markers []string
+}
+
+// sighting is the size and modification time of a file, and when scans
+// first found it with them.
+type sighting struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// filter returns the files that are complete, looking for their markers
+// among all the entries of the input dir.
+func (c *completion) filter(files, entries []os.FileInfo) []os.FileInfo {
+	names := make(map[string]bool, len(entries))
+	for _, info := range entries {
+		names[info.Name()] = true
+	}
+	now := time.Now()
+	seen := c.seen
+	c.seen = make(map[string]sighting, len(files))
+
+	var complete []os.FileInfo
+	for _, info := range files {
+		name := info.Name()
+		if c.ignored(name) || c.isMarker(name) {
+			continue
+		}
+		if c.stable {
+			s, ok := seen[name]
+			if !ok || s.size != info.Size() || !s.modTime.Equal(info.ModTime()) {
+				s = sighting{size: info.Size(), modTime: info.ModTime(), since: now}
+			}
+			c.seen[name] = s
+			if now.Sub(s.since) < c.stableFor {
+				log.Printf("File %v may still be being written, waiting for the next scan", name)
+				continue
+			}
+		}
+		if c.minAge > 0 && time.Since(info.ModTime()) < c.minAge {
+			log.Printf("File %v is too recent, waiting for the next scan", name)
+			continue
+		}
+		if len(c.markers) > 0 && c.marker(name, names) == "" {
+			continue
+		}
+		complete = append(complete, info)
+	}
+	return complete
+}
+
+// ignored tells whether the base name of a file matches an ignore pattern.
+func (c *completion) ignored(name string) bool {
+	base := filepath.Base(name)
+	for _, pattern := range c.ignore {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *completion) isMarker(name string) bool {
+	for _, suffix := range c.markers {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// marker returns the name of the marker of the named file among names, or
+// "" if there is none.
+func (c *completion) marker(name string, names map[string]bool) string {
+	for _, suffix := range c.markers {
+		if names[name+suffix] {
+			return name + suffix
+		}
+	}
+	return ""
+}
+
+// removeMarkers removes the markers of a file that has left the input dir.
+func (r *dirReader) removeMarkers(name string) {
+	for _, suffix := range r.completion.markers {
+		path := filepath.Join(r.inputDir, name+suffix)
+		err := r.fs.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove marker %v: %v", path, err)
+		}
+	}
+}
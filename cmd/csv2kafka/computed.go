@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/sdx13/csv2kafka/internal/expr"
+)
+
+// fileNameField is the name under which computed field expressions can refer
+// to the base name of the file the record was read from.
+const fileNameField = "_file"
+
+// computedField is a field that is not present in the CSV but is derived
+// from the converted source fields by evaluating an expression. Computed
+// fields are added to the schema as nullable fields of the given type and
+// are evaluated in order, so later ones can refer to earlier ones.
+type computedField struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	Expr string `yaml:"expr"`
+
+	expr *expr.Expr
+}
+
+func compileComputedFields(fields []computedField) error {
+	for i := range fields {
+		f := &fields[i]
+		if f.Name == "" {
+			return fmt.Errorf("computed field %d has no name", i)
+		}
+		switch f.Type {
+		case "string", "long", "int", "double", "float", "boolean":
+		default:
+			return fmt.Errorf("computed field %v: unsupported type %q", f.Name, f.Type)
+		}
+		var err error
+		f.expr, err = expr.Parse(f.Expr)
+		if err != nil {
+			return fmt.Errorf("computed field %v: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// computeFields evaluates the computed fields and adds them to datum.
+func computeFields(fields []computedField, datum map[string]interface{}, fileName string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	datum[fileNameField] = filepath.Base(fileName)
+	defer delete(datum, fileNameField)
+	for _, f := range fields {
+		v, err := f.expr.Eval(datum)
+		if err != nil {
+			return fmt.Errorf("computed field %v: %v", f.Name, err)
+		}
+		if v == nil {
+			datum[f.Name] = nil
+			continue
+		}
+		v, err = coerce(f.Type, v)
+		if err != nil {
+			return fmt.Errorf("computed field %v: %v", f.Name, err)
+		}
+		datum[f.Name] = goavro.Union(f.Type, v)
+	}
+	return nil
+}
+
+// coerce converts a value produced by an expression to the native Go type
+// goavro expects for avroType.
+func coerce(avroType string, v interface{}) (interface{}, error) {
+	switch avroType {
+	case "string":
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		}
+		return fmt.Sprint(v), nil
+	case "long", "int":
+		var i int64
+		switch v := v.(type) {
+		case int64:
+			i = v
+		case float64:
+			i = int64(v)
+		case string:
+			var err error
+			i, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("cannot convert %T to %v", v, avroType)
+		}
+		if avroType == "int" {
+			return int32(i), nil
+		}
+		return i, nil
+	case "double", "float":
+		var f float64
+		switch v := v.(type) {
+		case int64:
+			f = float64(v)
+		case float64:
+			f = v
+		case string:
+			var err error
+			f, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("cannot convert %T to %v", v, avroType)
+		}
+		if avroType == "float" {
+			return float32(f), nil
+		}
+		return f, nil
+	case "boolean":
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+		return nil, fmt.Errorf("cannot convert %T to boolean", v)
+	}
+	return nil, fmt.Errorf("unsupported type %q", avroType)
+}
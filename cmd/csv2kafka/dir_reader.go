@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileSystem is what the readers need from the local or SFTP filesystem.
+type fileSystem interface {
+	ReadDir(path string) ([]os.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+	Rename(from, to string) error
+	Create(path string) (io.WriteCloser, error)
+	Remove(path string) error
+	MkdirAll(path string) error
+}
+
+// inputFile is a file being read.
+type inputFile struct {
+	name   string
+	f      io.ReadCloser
+	reader *GzipReader
+	id     fileIdentity
+	// line is the number of records read from the file so far, acked
+	// the number of those that have been acknowledged and saved the
+	// number recorded in the last checkpoint.
+	line  int
+	acked int
+	saved int
+	// rejected is the number of records that could not be published.
+	rejected int
+	// details is the number of detail rows up to the acknowledged
+	// record, restored on resuming to be checked against the trailer.
+	details int
+	// publishErr is the error writing a record to Kafka, once one
+	// failed.
+	publishErr error
+}
+
+// read returns the next record of the file. Malformed records are returned
+// as a *csv.ParseError, after which reading can go on.
+func (f *inputFile) read() ([]string, error) {
+	record, err := f.reader.Read()
+	if record != nil {
+		f.line++
+		return record, err
+	}
+	if _, ok := err.(*csv.ParseError); ok {
+		f.line++
+	}
+	return nil, err
+}
+
+// dirReader hands out the gzip compressed CSV files in inputDir to be read,
+// and post-processes each, by default moving it to readyDir, once its
+// records have been acknowledged. It is shared by the local and SFTP
+// readers, which differ only in their fileSystem.
+//
+// Next is called by a single goroutine, while Ack, Reject and Finish may be
+// called by another.
+type dirReader struct {
+	// source names the source in the checkpoints of its files when there
+	// are several.
+	source       string
+	fs           fileSystem
+	inputDir     string
+	readyDir     string
+	waitInterval int
+
+	checkpoints        checkpointStore
+	checkpointInterval int
+
+	// Files whose checksum is in registry are moved to duplicateDir
+	// instead of being read.
+	registry     *fileRegistry
+	duplicateDir string
+
+	// Files that fail to open maxAttempts times in a row, or with more
+	// than maxRejectedRatio of their records rejected, are moved to
+	// errorDir.
+	errorDir         string
+	maxAttempts      int
+	maxRejectedRatio float64
+
+	// scanDepth is how many levels of subdirectories are scanned, and
+	// cleanupDirs whether subdirectories are removed once emptied.
+	scanDepth   int
+	cleanupDirs bool
+
+	selection  selection
+	completion completion
+	post       postProcessing
+
+	// watcher wakes the reader up when files appear, or after
+	// waitInterval if the input dir is polled.
+	watcher watcher
+
+	// state is where Next is in its cycle, files the files left from
+	// the last scan and opened whether any of them has been opened.
+	state  readerState
+	files  []os.FileInfo
+	opened bool
+
+	// mu guards the states of the files being read, which later scans
+	// must skip, the failure counts, when files that failed to publish may
+	// be read again and, without a checkpoint store, how far the files
+	// left to be read again were acknowledged.
+	mu       sync.Mutex
+	inFlight map[string]readerState
+	failures map[string]int
+	retries  map[string]retry
+	left     map[string]*checkpoint
+}
+
+// readerState is the state of a reader or of one of its files. A reader
+// cycles through scanning the input dir, opening the files found, one per
+// call to Next, and waiting for more once none is left. A file it opens
+// goes on from reading to draining, once read to the end while its last
+// records are being published, and to post-processing.
+type readerState int
+
+const (
+	stateScanning readerState = iota
+	stateReading
+	stateIdle
+	stateDraining
+	statePostProcessing
+)
+
+func (s readerState) String() string {
+	switch s {
+	case stateScanning:
+		return "scanning"
+	case stateReading:
+		return "reading"
+	case stateIdle:
+		return "idle"
+	case stateDraining:
+		return "draining"
+	case statePostProcessing:
+		return "post-processing"
+	}
+	return fmt.Sprintf("readerState(%d)", int(s))
+}
+
+// errStopped is passed to Finish for files whose reading was stopped by a
+// shutdown.
+var errStopped = errors.New("stopped")
+
+// errPublishFailed is passed to Finish for files a record of which could not
+// be written to Kafka.
+var errPublishFailed = errors.New("publish failed")
+
+// errConnectionLost is returned by the reads of a remote file once the
+// connection to the server is lost. The file is resumed from its checkpoint
+// after reconnecting.
+var errConnectionLost = errors.New("connection lost")
+
+// Next opens the next file to read, waiting for one to appear if there is
+// none. It returns the context's error once the context is done. A failed
+// scan is returned too, and retried after waitInterval.
+func (r *dirReader) Next(ctx context.Context) (*inputFile, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		switch r.state {
+		case stateScanning:
+			files, err := r.scan()
+			if err != nil {
+				log.Printf("Failed to read input dir: %v", err)
+				r.state = stateIdle
+				return nil, err
+			}
+			r.files = r.completion.filter(r.selection.filter(files), files)
+			r.selection.sort(r.files)
+			r.opened = false
+			r.state = stateReading
+		case stateReading:
+			if current := r.openNext(); current != nil {
+				r.opened = true
+				return current, nil
+			}
+			if r.opened {
+				// Files may have appeared while those
+				// found were opened.
+				r.state = stateScanning
+				continue
+			}
+			log.Println("No input file found")
+			r.state = stateIdle
+		case stateIdle:
+			log.Printf("Waiting for files for up to %v seconds", r.waitInterval)
+			r.watcher.Wait(ctx, time.Duration(r.waitInterval)*time.Second)
+			r.state = stateScanning
+		}
+	}
+}
+
+// openNext opens the first of the files left from the last scan that can be
+// read, or returns nil if there is none.
+func (r *dirReader) openNext() *inputFile {
+	for len(r.files) > 0 {
+		info := r.files[0]
+		r.files = r.files[1:]
+		if r.reading(info.Name()) || r.backingOff(info.Name()) {
+			continue
+		}
+		current, err := r.open(info)
+		if err == errDuplicate || err == errDone {
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to open file", err)
+			r.fail(info.Name(), "open failed", err)
+			continue
+		}
+		r.mu.Lock()
+		delete(r.failures, info.Name())
+		if r.inFlight == nil {
+			r.inFlight = make(map[string]readerState)
+		}
+		r.inFlight[info.Name()] = stateReading
+		r.mu.Unlock()
+		return current
+	}
+	return nil
+}
+
+func (r *dirReader) reading(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.inFlight[name]
+	return ok
+}
+
+func (r *dirReader) setState(name string, state readerState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inFlight[name] = state
+}
+
+// Drain marks a file as read to the end, or as far as it will be, while its
+// last records are being published.
+func (r *dirReader) Drain(current *inputFile) {
+	r.setState(current.name, stateDraining)
+}
+
+// Finish closes a file whose records have all been acknowledged, and moves
+// it out of the input dir. If reading it failed with err, the file is left
+// to be read again, or moved to the error dir after too many attempts. A
+// file stopped by a shutdown is left to be resumed from its checkpoint.
+func (r *dirReader) Finish(current *inputFile, err error) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.inFlight, current.name)
+		r.mu.Unlock()
+		r.release(current)
+	}()
+	if r.checkpoints != nil && current.acked != current.saved {
+		r.saveCheckpoint(current)
+	}
+	closeErr := current.close()
+	if closeErr != nil {
+		log.Printf("Error closing file %v: %v", current.name, closeErr)
+	} else {
+		log.Println("Closed file", current.name)
+	}
+	if err == errStopped {
+		log.Printf("Stopped reading file %v after record %d", current.name, current.acked)
+		r.leave(current)
+		return
+	}
+	if err == errPublishFailed {
+		delay := r.backOff(current.name)
+		log.Printf("Failed to publish record %d of file %v, leaving it to be read again in %v", current.acked+1, current.name, delay)
+		r.leave(current)
+		r.fail(current.name, "publish failed", current.publishErr)
+		return
+	}
+	if err == errConnectionLost {
+		log.Printf("Lost connection reading file %v after record %d, leaving it to be read again", current.name, current.acked)
+		r.leave(current)
+		return
+	}
+	if terr, ok := err.(*trailerError); ok {
+		log.Printf("Trailer check failed for file %v: %v", current.name, terr)
+		if r.errorDir != "" {
+			r.fail(current.name, "trailer mismatch", terr)
+			return
+		}
+		err = nil
+	}
+	if err != nil && err != io.EOF {
+		log.Printf("Error reading file %v: %v", current.name, err)
+		if r.errorDir != "" {
+			// Leave the file to be read again, from its
+			// checkpoint if there is one.
+			r.leave(current)
+			r.fail(current.name, "read failed", err)
+			return
+		}
+	}
+	r.setState(current.name, statePostProcessing)
+	r.finish(current)
+	r.mu.Lock()
+	delete(r.left, current.id.Name)
+	delete(r.retries, current.name)
+	r.mu.Unlock()
+}
+
+// Delays before a file whose records failed to be published is read again,
+// which double with each failure from publishRetryMinDelay up to
+// publishRetryMaxDelay.
+const (
+	publishRetryMinDelay = 10 * time.Second
+	publishRetryMaxDelay = 10 * time.Minute
+)
+
+// retry is when a file may be read again after failed attempts.
+type retry struct {
+	attempts int
+	at       time.Time
+}
+
+// backOff records a failed attempt at a file and returns how long to wait
+// before the next.
+func (r *dirReader) backOff(name string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.retries == nil {
+		r.retries = make(map[string]retry)
+	}
+	rt := r.retries[name]
+	rt.attempts++
+	delay := publishRetryMinDelay
+	for i := 1; i < rt.attempts && delay < publishRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > publishRetryMaxDelay {
+		delay = publishRetryMaxDelay
+	}
+	rt.at = time.Now().Add(delay)
+	r.retries[name] = rt
+	return delay
+}
+
+// backingOff tells whether a file is waiting to be read again.
+func (r *dirReader) backingOff(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rt, ok := r.retries[name]
+	return ok && time.Now().Before(rt.at)
+}
+
+// leave remembers how far a file left in the input dir was acknowledged,
+// to resume it from there if there is no checkpoint store. This does not
+// survive a restart.
+func (r *dirReader) leave(current *inputFile) {
+	if r.checkpoints != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.left == nil {
+		r.left = make(map[string]*checkpoint)
+	}
+	r.left[current.id.Name] = &checkpoint{fileIdentity: current.id, Line: current.acked, Rejected: current.rejected, Details: current.details}
+}
+
+// finish moves a file that has been read to the ready dir, or to the error
+// dir if too many of its records were rejected.
+func (r *dirReader) finish(current *inputFile) {
+	var err error
+	if r.tooManyRejected(current) {
+		log.Printf("File %v has %d of %d records rejected", current.name, current.rejected, current.line)
+		err = r.quarantine(current.name, &fileError{
+			Reason:       "too many rejected records",
+			Rows:         current.line,
+			RejectedRows: current.rejected,
+		})
+	} else {
+		if r.registry != nil {
+			if err := r.registry.add(current.id.Checksum, current.id.Name); err != nil {
+				log.Printf("Failed to register file %v: %v", current.name, err)
+			}
+		}
+		err = r.postProcess(current)
+	}
+	if err == nil && r.checkpoints != nil && r.post.action != postProcessLeave {
+		// Until the file has left the input dir, its checkpoint keeps
+		// it from being read again.
+		if err := r.checkpoints.Delete(current.id.Name); err != nil {
+			log.Printf("Failed to delete checkpoint for %v: %v", current.name, err)
+		}
+	}
+}
+
+// Close releases the reader's resources.
+func (r *dirReader) Close() error {
+	return nil
+}
+
+// key returns the name under which the named file is checkpointed and
+// registered.
+func (r *dirReader) key(name string) string {
+	if r.source == "" {
+		return name
+	}
+	return r.source + "/" + name
+}
+
+// Ack acknowledges the records of a file up to the given one as processed,
+// so that they are not read again after a restart. Records must be
+// acknowledged in order.
+func (r *dirReader) Ack(current *inputFile, line int) {
+	current.acked = line
+	if r.checkpoints == nil {
+		return
+	}
+	if r.checkpointInterval <= 0 || current.acked-current.saved < r.checkpointInterval {
+		return
+	}
+	r.saveCheckpoint(current)
+}
+
+// Reject acknowledges a record that could not be published. Files with too
+// many rejected records go to the error dir.
+func (r *dirReader) Reject(current *inputFile, line int) {
+	current.rejected++
+	r.Ack(current, line)
+}
+
+func (r *dirReader) saveCheckpoint(current *inputFile) {
+	cp := &checkpoint{fileIdentity: current.id, Line: current.acked, Rejected: current.rejected, Details: current.details}
+	if err := r.checkpoints.Save(cp); err != nil {
+		log.Printf("Failed to save checkpoint for %v: %v", current.name, err)
+		return
+	}
+	current.saved = current.acked
+}
+
+// errDuplicate is returned by open for files that have been processed
+// before, and errDone for files that have been read and left in place.
+var (
+	errDuplicate = errors.New("duplicate file")
+	errDone      = errors.New("file done")
+)
+
+// open opens a file for reading, skipping the records acknowledged before a
+// restart if there is a checkpoint for it, or before it was left to be read
+// again. Files processed before are moved to the duplicate dir and
+// errDuplicate is returned.
+func (r *dirReader) open(info os.FileInfo) (*inputFile, error) {
+	name := filepath.Join(r.inputDir, info.Name())
+	var cp *checkpoint
+	if r.checkpoints == nil {
+		r.mu.Lock()
+		cp = r.left[r.key(info.Name())]
+		r.mu.Unlock()
+	} else {
+		var err error
+		cp, err = r.checkpoints.Load(r.key(info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		// Files left in place are recognised without reading them.
+		if cp != nil && cp.Done && cp.Size == info.Size() && cp.ModTime.Equal(info.ModTime()) {
+			return nil, errDone
+		}
+	}
+	log.Println("Reading file", name)
+	current := &inputFile{
+		name: info.Name(),
+		id: fileIdentity{
+			Name:    r.key(info.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		},
+	}
+	if r.checkpoints != nil || r.registry != nil {
+		var err error
+		current.id.Checksum, err = r.checksum(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var resume int
+	resuming := false
+	if cp != nil {
+		switch {
+		case cp.fileIdentity.equal(current.id):
+			resume = cp.Line
+			resuming = true
+			current.rejected = cp.Rejected
+			current.details = cp.Details
+		default:
+			log.Printf("File %v changed since its checkpoint, reading it from the start", name)
+		}
+	}
+	if r.registry != nil {
+		seen, reading, ok := r.registry.reserve(current.id.Checksum, current.id.Name, resuming)
+		if reading != "" {
+			log.Printf("File %v has the same content as %v, which is being read; leaving it for a later scan", name, reading)
+			return nil, errDuplicate
+		}
+		if !ok {
+			r.moveDuplicate(info.Name(), seen)
+			return nil, errDuplicate
+		}
+	}
+
+	f, err := r.fs.Open(name)
+	if err != nil {
+		r.release(current)
+		return nil, err
+	}
+	reader, err := NewGzipReader(f)
+	if err != nil {
+		f.Close()
+		r.release(current)
+		return nil, fmt.Errorf("failed to create gzip reader for %v: %v", name, err)
+	}
+	current.f = f
+	current.reader = reader
+	if resume > 0 {
+		log.Printf("Resuming file %v after record %d", name, resume)
+		for current.line < resume {
+			if _, err := reader.Read(); err != nil {
+				if _, ok := err.(*csv.ParseError); !ok {
+					break
+				}
+			}
+			current.line++
+		}
+		current.acked = current.line
+		current.saved = current.line
+	}
+	return current, nil
+}
+
+// release releases the registry's reservation of a file, once it is no
+// longer being read.
+func (r *dirReader) release(current *inputFile) {
+	if r.registry != nil {
+		r.registry.release(current.id.Checksum, current.id.Name)
+	}
+}
+
+func (r *dirReader) moveDuplicate(name string, seen seenFile) {
+	from := filepath.Join(r.inputDir, name)
+	to := filepath.Join(r.duplicateDir, name)
+	log.Printf("File %v has the same content as %v, processed at %v; moving it to %v",
+		from, seen.Name, seen.Time.Format(time.RFC3339), to)
+	r.move(name, r.duplicateDir)
+}
+
+func (r *dirReader) checksum(name string) (string, error) {
+	f, err := r.fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (f *inputFile) close() error {
+	err := f.reader.Close()
+	if err2 := f.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
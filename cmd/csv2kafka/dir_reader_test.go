@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFS is a fileSystem held in memory.
+type memFS struct {
+	mu      sync.Mutex
+	files   map[string][]byte
+	readErr error
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte)}
+}
+
+// add writes a gzip compressed file with the given CSV lines.
+func (fs *memFS) add(t *testing.T, path string, lines ...string) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		io.WriteString(zw, line+"\n")
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[path] = buf.Bytes()
+}
+
+func (fs *memFS) has(path string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, ok := fs.files[path]
+	return ok
+}
+
+func (fs *memFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.readErr != nil {
+		return nil, fs.readErr
+	}
+	var infos []os.FileInfo
+	for path, content := range fs.files {
+		if filepath.Dir(path) == dir {
+			infos = append(infos, memFileInfo{name: filepath.Base(path), size: int64(len(content))})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *memFS) Open(path string) (io.ReadCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	content, ok := fs.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (fs *memFS) Rename(from, to string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	content, ok := fs.files[from]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, from)
+	fs.files[to] = content
+	return nil
+}
+
+func (fs *memFS) Create(path string) (io.WriteCloser, error) {
+	return nil, errors.New("not supported")
+}
+
+func (fs *memFS) Remove(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[path]; !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, path)
+	return nil
+}
+
+func (fs *memFS) MkdirAll(path string) error {
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// fakeWatcher counts the waits, running onWait instead of sleeping.
+type fakeWatcher struct {
+	waits  int
+	onWait func()
+}
+
+func (w *fakeWatcher) Watch(dir string) error {
+	return nil
+}
+
+func (w *fakeWatcher) Wait(ctx context.Context, timeout time.Duration) {
+	w.waits++
+	if w.onWait != nil {
+		w.onWait()
+	}
+}
+
+func newTestReader(fs *memFS, w *fakeWatcher) *dirReader {
+	return &dirReader{
+		fs:           fs,
+		inputDir:     "in",
+		readyDir:     "ready",
+		waitInterval: 3600,
+		watcher:      w,
+	}
+}
+
+// finishFile reads a file to the end, acknowledging its records, and
+// finishes it.
+func finishFile(t *testing.T, r *dirReader, f *inputFile) {
+	for {
+		row, err := f.read()
+		if row == nil {
+			r.Drain(f)
+			if got := r.inFlight[f.name]; got != stateDraining {
+				t.Errorf("state of %v = %v, want %v", f.name, got, stateDraining)
+			}
+			r.Finish(f, err)
+			return
+		}
+		r.Ack(f, f.line)
+	}
+}
+
+func TestNextReadsFilesInOrderThenWaits(t *testing.T) {
+	fs := newMemFS()
+	fs.add(t, "in/b.csv.gz", "2")
+	fs.add(t, "in/a.csv.gz", "1")
+	w := &fakeWatcher{}
+	r := newTestReader(fs, w)
+	w.onWait = func() {
+		fs.add(t, "in/c.csv.gz", "3")
+	}
+	ctx := context.Background()
+
+	for _, want := range []string{"a.csv.gz", "b.csv.gz"} {
+		f, err := r.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.name != want {
+			t.Fatalf("Next() = %v, want %v", f.name, want)
+		}
+		if r.state != stateReading {
+			t.Errorf("reader state = %v, want %v", r.state, stateReading)
+		}
+		if got := r.inFlight[f.name]; got != stateReading {
+			t.Errorf("state of %v = %v, want %v", f.name, got, stateReading)
+		}
+		finishFile(t, r, f)
+		if r.reading(f.name) {
+			t.Errorf("%v still in flight after Finish", f.name)
+		}
+		if !fs.has("ready/" + want) {
+			t.Errorf("%v not moved to the ready dir", want)
+		}
+	}
+	if w.waits != 0 {
+		t.Fatalf("waited %d times with files to read", w.waits)
+	}
+
+	f, err := r.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.name != "c.csv.gz" {
+		t.Fatalf("Next() = %v, want c.csv.gz", f.name)
+	}
+	if w.waits != 1 {
+		t.Errorf("waited %d times, want 1", w.waits)
+	}
+}
+
+func TestNextRescansAfterOpeningFiles(t *testing.T) {
+	fs := newMemFS()
+	fs.add(t, "in/a.csv.gz", "1")
+	w := &fakeWatcher{}
+	r := newTestReader(fs, w)
+	ctx := context.Background()
+
+	f, err := r.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file appearing while the first is read is found by a new scan,
+	// without waiting, and the one being read is skipped.
+	fs.add(t, "in/b.csv.gz", "2")
+	g, err := r.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.name != "b.csv.gz" {
+		t.Fatalf("Next() = %v, want b.csv.gz", g.name)
+	}
+	if w.waits != 0 {
+		t.Errorf("waited %d times, want 0", w.waits)
+	}
+	finishFile(t, r, f)
+	finishFile(t, r, g)
+}
+
+func TestNextIdlesAfterScanError(t *testing.T) {
+	fs := newMemFS()
+	fs.readErr = errors.New("unreachable")
+	w := &fakeWatcher{}
+	r := newTestReader(fs, w)
+	ctx := context.Background()
+
+	if _, err := r.Next(ctx); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("Next() error = %v, want the scan error", err)
+	}
+	if r.state != stateIdle {
+		t.Errorf("reader state = %v, want %v", r.state, stateIdle)
+	}
+	w.onWait = func() {
+		fs.mu.Lock()
+		fs.readErr = nil
+		fs.mu.Unlock()
+		fs.add(t, "in/a.csv.gz", "1")
+	}
+	f, err := r.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.name != "a.csv.gz" || w.waits != 1 {
+		t.Errorf("Next() = %v after %d waits, want a.csv.gz after 1", f.name, w.waits)
+	}
+}
+
+func TestNextReturnsWhenContextDone(t *testing.T) {
+	fs := newMemFS()
+	w := &fakeWatcher{}
+	r := newTestReader(fs, w)
+	ctx, cancel := context.WithCancel(context.Background())
+	w.onWait = cancel
+
+	if _, err := r.Next(ctx); err != context.Canceled {
+		t.Fatalf("Next() error = %v, want %v", err, context.Canceled)
+	}
+	if w.waits != 1 {
+		t.Errorf("waited %d times, want 1", w.waits)
+	}
+}
+
+func TestFinishBacksOffAfterPublishFailure(t *testing.T) {
+	fs := newMemFS()
+	fs.add(t, "in/a.csv.gz", "1")
+	w := &fakeWatcher{}
+	r := newTestReader(fs, w)
+	ctx, cancel := context.WithCancel(context.Background())
+	w.onWait = cancel
+
+	f, err := r.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.publishErr = errors.New("message too large")
+	r.Finish(f, errPublishFailed)
+	if !fs.has("in/a.csv.gz") {
+		t.Fatal("file moved away after a failed publish")
+	}
+	// The file is skipped until its delay has passed.
+	if _, err := r.Next(ctx); err != context.Canceled {
+		t.Fatalf("Next() error = %v, want %v", err, context.Canceled)
+	}
+
+	r.errorDir = "error"
+	r.maxAttempts = 1
+	r.retries = nil
+	f, err = r.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.publishErr = errors.New("message too large")
+	r.Finish(f, errPublishFailed)
+	if !fs.has("error/a.csv.gz") {
+		t.Error("file not moved to the error dir after max_file_attempts failed publishes")
+	}
+}
+
+func TestFinishQuarantinesTrailerMismatch(t *testing.T) {
+	fs := newMemFS()
+	fs.add(t, "in/a.csv.gz", "D", "T,2")
+	w := &fakeWatcher{}
+	r := newTestReader(fs, w)
+	r.errorDir = "error"
+	r.maxAttempts = 3
+
+	f, err := r.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Finish(f, &trailerError{errors.New("trailer announces 2 detail rows, read 1")})
+	if !fs.has("error/a.csv.gz") {
+		t.Error("file not moved to the error dir on its first trailer mismatch")
+	}
+}
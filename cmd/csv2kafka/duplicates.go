@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// seenFile is an entry of the registry of processed files.
+type seenFile struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// fileRegistry remembers the SHA-256 checksums of the files processed within
+// the retention window, so that a file delivered again, under any name, can
+// be recognised. It is kept in a local JSON file.
+type fileRegistry struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	seen      map[string]seenFile
+	// reading maps the checksums of the files being read to their
+	// names, so that copies found meanwhile are not read too.
+	reading map[string]string
+}
+
+func newFileRegistry(path string, retention time.Duration) (*fileRegistry, error) {
+	reg := &fileRegistry{
+		path:      path,
+		retention: retention,
+		seen:      make(map[string]seenFile),
+		reading:   make(map[string]string),
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &reg.seen); err != nil {
+		return nil, fmt.Errorf("file registry %v: %v", path, err)
+	}
+	reg.expire()
+	return reg, nil
+}
+
+// reserve records that the named file is being read, unless a file with the
+// same checksum is, whose name is returned, or was processed before, which
+// is returned unless resuming.
+func (reg *fileRegistry) reserve(checksum, name string, resuming bool) (seen seenFile, reading string, ok bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if other, ok := reg.reading[checksum]; ok && other != name {
+		return seenFile{}, other, false
+	}
+	if f, ok := reg.seen[checksum]; ok && !resuming && !reg.expired(f) {
+		return f, "", false
+	}
+	reg.reading[checksum] = name
+	return seenFile{}, "", true
+}
+
+// release records that the named file is no longer being read.
+func (reg *fileRegistry) release(checksum, name string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.reading[checksum] == name {
+		delete(reg.reading, checksum)
+	}
+}
+
+// add records a processed file.
+func (reg *fileRegistry) add(checksum, name string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.expire()
+	reg.seen[checksum] = seenFile{Name: name, Time: time.Now()}
+	content, err := json.MarshalIndent(reg.seen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(reg.path, content)
+}
+
+func (reg *fileRegistry) expired(f seenFile) bool {
+	return reg.retention > 0 && time.Since(f.Time) > reg.retention
+}
+
+func (reg *fileRegistry) expire() {
+	for checksum, f := range reg.seen {
+		if reg.expired(f) {
+			delete(reg.seen, checksum)
+		}
+	}
+}
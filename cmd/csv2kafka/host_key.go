@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes.
+const (
+	hostKeyCheckNone   = "none"
+	hostKeyCheckStrict = "strict"
+)
+
+// newHostKeyCallback returns the verification of the host key of an SSH
+// server. In strict mode, the default, the key must match one of the pinned
+// fingerprints if there are any, or else be listed in the known_hosts file,
+// which defaults to ~/.ssh/known_hosts. Settings that cannot be used are an
+// error rather than a reason to skip the check; only an explicit none does.
+func newHostKeyCallback(host, check, knownHosts string, fingerprints []string) (ssh.HostKeyCallback, error) {
+	switch check {
+	case hostKeyCheckNone:
+		log.Printf("Warning: host key checking is off for %v, so its identity is not verified", host)
+		return ssh.InsecureIgnoreHostKey(), nil
+	case "", hostKeyCheckStrict:
+	default:
+		return nil, fmt.Errorf("unknown host key check %q", check)
+	}
+	if len(fingerprints) > 0 {
+		return pinnedHostKeys(fingerprints), nil
+	}
+	if knownHosts == "" {
+		knownHosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %v", err)
+	}
+	return callback, nil
+}
+
+// pinnedHostKeys accepts the host keys with the given fingerprints, in the
+// SHA256:... form printed by ssh-keygen -l, or the older MD5:xx:xx:... one.
+func pinnedHostKeys(fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		sha256 := ssh.FingerprintSHA256(key)
+		md5 := "MD5:" + ssh.FingerprintLegacyMD5(key)
+		for _, fp := range fingerprints {
+			if fp == sha256 || strings.EqualFold(fp, md5) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key %v of %v is not one of the pinned ones", sha256, hostname)
+	}
+}
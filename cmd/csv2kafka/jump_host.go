@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sdx13/csv2kafka/internal/secret"
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpHost is an SSH server through which the SFTP server is reached, with
+// its own credentials and host key checking.
+type jumpHost struct {
+	Host string `yaml:"host"`
+	Port string `yaml:"port,omitempty"`
+	User string `yaml:"user,omitempty"`
+
+	Password                 secret.Value `yaml:"password,omitempty"`
+	PasswordFile             string       `yaml:"password_file,omitempty"`
+	PrivateKeyPath           string       `yaml:"private_key_path,omitempty"`
+	PrivateKeyPassphrase     secret.Value `yaml:"private_key_passphrase,omitempty"`
+	PrivateKeyPassphraseFile string       `yaml:"private_key_passphrase_file,omitempty"`
+	CertificatePath          string       `yaml:"certificate_path,omitempty"`
+	AuthMethods              []string     `yaml:"auth_methods,omitempty"`
+
+	HostKeyCheck        string   `yaml:"host_key_check,omitempty"`
+	KnownHosts          string   `yaml:"known_hosts,omitempty"`
+	HostKeyFingerprints []string `yaml:"host_key_fingerprints,omitempty"`
+}
+
+func (j *jumpHost) resolveSecrets() error {
+	if err := j.Password.Resolve(j.PasswordFile); err != nil {
+		return fmt.Errorf("password: %v", err)
+	}
+	if err := j.PrivateKeyPassphrase.Resolve(j.PrivateKeyPassphraseFile); err != nil {
+		return fmt.Errorf("private_key_passphrase: %v", err)
+	}
+	return nil
+}
+
+// sshHop is a jump host ready to be dialed.
+type sshHop struct {
+	addr            string
+	auth            *sshAuth
+	hostKeyCallback ssh.HostKeyCallback
+}
+
+func newSSHHops(jumps []jumpHost) ([]sshHop, error) {
+	var hops []sshHop
+	for _, j := range jumps {
+		port := j.Port
+		if port == "" {
+			port = "22"
+		}
+		hostKeyCallback, err := newHostKeyCallback(j.Host, j.HostKeyCheck, j.KnownHosts, j.HostKeyFingerprints)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %v: %v", j.Host, err)
+		}
+		auth, err := newSSHAuth(sshCredentials{
+			User:                 j.User,
+			Password:             string(j.Password),
+			PrivateKeyPath:       j.PrivateKeyPath,
+			PrivateKeyPassphrase: string(j.PrivateKeyPassphrase),
+			CertificatePath:      j.CertificatePath,
+			AuthMethods:          j.AuthMethods,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("jump host %v: %v", j.Host, err)
+		}
+		hops = append(hops, sshHop{
+			addr:            net.JoinHostPort(j.Host, port),
+			auth:            auth,
+			hostKeyCallback: hostKeyCallback,
+		})
+	}
+	return hops, nil
+}
+
+// dialVia connects to addr through the last of the given clients, or
+// directly if there is none. Dialing and the SSH handshake together take at
+// most config.Timeout, and are abandoned once ctx is done.
+func dialVia(ctx context.Context, clients []*ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	var conn net.Conn
+	var err error
+	if len(clients) == 0 {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialThrough(ctx, clients[len(clients)-1], addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections through a jump host do not support deadlines, so the
+	// connection is also closed if ctx is done during the handshake.
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := closeOnDone(ctx, conn)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if stop() {
+		if err == nil {
+			c.Close()
+		}
+		err = fmt.Errorf("ssh handshake: %v", ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialThrough connects to addr through an SSH client, giving up once ctx
+// is done.
+func dialThrough(ctx context.Context, client *ssh.Client, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial("tcp", addr)
+		dialed <- result{conn, err}
+	}()
+	select {
+	case r := <-dialed:
+		return r.conn, r.err
+	case <-ctx.Done():
+		// Close the connection if it is made after all.
+		go func() {
+			if r := <-dialed; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// closeOnDone closes conn if ctx is done before the returned function is
+// called, which reports whether it was.
+func closeOnDone(ctx context.Context, conn net.Conn) func() bool {
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-closed
+	}
+}
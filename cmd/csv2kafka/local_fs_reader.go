@@ -1,95 +1,39 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"io"
 	"os"
-	"path/filepath"
-	"time"
 )
 
 type LocalFilesystemReader struct {
-	inputDir     string
-	readyDir     string
-	waitInterval int
+	*dirReader
+}
+
+// localFileSystem is the fileSystem of the machine csv2kafka runs on.
+type localFileSystem struct{}
 
-	files  []os.FileInfo
-	reader *GzipReader
-	index  int
-	f      *os.File
+func (localFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	return readDir(path)
 }
 
-func (r *LocalFilesystemReader) Read() ([]string, error) {
-	if len(r.files) == 0 {
-		i := 0
-		log.Println("Scanning for files in dir", r.inputDir)
-		files, err := readDir(r.inputDir)
-		if err != nil {
-			log.Printf("Failed to read input dir: %v", err)
-			return nil, err
-		}
-		for ; i < len(files); i++ {
-			name := filepath.Join(r.inputDir, files[i].Name())
-			log.Println("Reading file", name)
-			f, err := os.Open(name)
-			if err != nil {
-				log.Println("Failed to open file", err)
-				continue
-			}
-			reader, err := NewGzipReader(f)
-			if err == nil {
-				r.reader = reader
-				r.index = i
-				r.f = f
-				r.files = files
-				break
-			} else {
-				log.Println("Failed to create gzip reader", err)
-			}
-		}
-		if i == len(files) {
-			log.Println("No input file found")
-			log.Printf("Waiting for %v seconds", r.waitInterval)
-			time.Sleep(time.Duration(r.waitInterval) * time.Second)
-			return r.Read()
-		}
-	}
-	record, err := r.reader.Read()
-	if record == nil {
-		err := r.close()
-		if err != nil {
-			log.Println("Error while closing file", err)
-		}
-		currentName := r.files[r.index].Name()
-		if err != nil {
-			fmt.Printf("Error closing file %v: %v", currentName, err)
-		} else {
-			log.Println("Closed file", currentName)
-		}
-		r.files = r.files[1:]
-		r.postProcess(currentName)
-		return r.Read()
-	}
-	return record, err
+func (localFileSystem) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
 }
 
-func (r *LocalFilesystemReader) close() error {
-	err := r.f.Close()
-	if err != nil {
-		return err
-	}
-	return r.reader.Close()
+func (localFileSystem) Rename(from, to string) error {
+	return os.Rename(from, to)
 }
 
-func (r *LocalFilesystemReader) postProcess(name string) {
-	from := filepath.Join(r.inputDir, name)
-	to := filepath.Join(r.readyDir, name)
-	err := os.Rename(from, to)
-	if err != nil {
-		fmt.Printf("Failed to rename %v to %v: %v", from, to, err)
-	} else {
-		log.Println("Processed", name)
-	}
+func (localFileSystem) Create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+func (localFileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localFileSystem) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
 }
 
 func readDir(path string) ([]os.FileInfo, error) {
@@ -2,34 +2,171 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/linkedin/goavro/v2"
+	"github.com/sdx13/csv2kafka/internal/secret"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
 	"gopkg.in/yaml.v2"
 )
 
 type config struct {
-	KafkaBrokers   string `yaml:"kafka_brokers,omitempty"`
-	KafkaTopic     string `yaml:"kafka_topic,omitempty"`
-	InputDir       string `yaml:"input_dir,omitempty"`
-	ReadyDir       string `yaml:"ready_dir,omitempty"`
-	WaitInterval   int    `yaml:"wait_interval,omitempty"`
-	SftpEnabled    bool   `yaml:"sftp_enabled,omitempty"`
-	SftpIp         string `yaml:"sftp_ip,omitempty"`
-	SftpPort       string `yaml:"sftp_port,omitempty"`
-	SftpUser       string `yaml:"sftp_user,omitempty"`
-	SftpPassword   string `yaml:"sftp_password,omitempty"`
-	PrivateKeyPath string `yaml:"private_key_path,omitempty"`
+	KafkaBrokers string `yaml:"kafka_brokers,omitempty"`
+
+	CheckpointStore string `yaml:"checkpoint_store,omitempty"`
+	CheckpointFile  string `yaml:"checkpoint_file,omitempty"`
+	CheckpointTopic string `yaml:"checkpoint_topic,omitempty"`
+	TransactionalID string `yaml:"transactional_id,omitempty"`
+
+	FileRegistry           string `yaml:"file_registry,omitempty"`
+	DuplicateRetentionDays int    `yaml:"duplicate_retention_days,omitempty"`
+
+	// The top-level source settings are used when there is no sources
+	// list, and as the defaults of the sources in it otherwise.
+	sourceConfig `yaml:",inline"`
+	Sources      []sourceConfig `yaml:"sources,omitempty"`
 }
 
+// sourceConfig holds the settings of one input directory and the records
+// read from it.
+type sourceConfig struct {
+	Name           string           `yaml:"name,omitempty"`
+	Type           string           `yaml:"type,omitempty"`
+	KafkaTopic     string           `yaml:"kafka_topic,omitempty"`
+	InputDir       string           `yaml:"input_dir,omitempty"`
+	ReadyDir       string           `yaml:"ready_dir,omitempty"`
+	WaitInterval   int              `yaml:"wait_interval,omitempty"`
+	SftpEnabled    bool             `yaml:"sftp_enabled,omitempty"`
+	SftpIp         string           `yaml:"sftp_ip,omitempty"`
+	SftpPort       string           `yaml:"sftp_port,omitempty"`
+	SftpUser       string           `yaml:"sftp_user,omitempty"`
+	SftpPassword   secret.Value     `yaml:"sftp_password,omitempty"`
+	PrivateKeyPath string           `yaml:"private_key_path,omitempty"`
+	Filter         string           `yaml:"filter,omitempty"`
+	ComputedFields []computedField  `yaml:"computed_fields,omitempty"`
+	ProtectFields  []protectedField `yaml:"protect_fields,omitempty"`
+	RecordName     string           `yaml:"record_name,omitempty"`
+	TimeZone       string           `yaml:"time_zone,omitempty"`
+	Mapping        []fieldMapping   `yaml:"mapping,omitempty"`
+
+	RecordTypes []recordTypeConfig `yaml:"record_types,omitempty"`
+
+	CheckpointInterval int `yaml:"checkpoint_interval,omitempty"`
+
+	DuplicateDir string `yaml:"duplicate_dir,omitempty"`
+
+	ErrorDir         string  `yaml:"error_dir,omitempty"`
+	MaxFileAttempts  int     `yaml:"max_file_attempts,omitempty"`
+	MaxRejectedRatio float64 `yaml:"max_rejected_ratio,omitempty"`
+
+	IgnorePatterns []string `yaml:"ignore_patterns,omitempty"`
+	MinFileAge     int      `yaml:"min_file_age,omitempty"`
+	RequireStable  bool     `yaml:"require_stable,omitempty"`
+	StableSeconds  int      `yaml:"stable_seconds,omitempty"`
+	DoneMarkers    []string `yaml:"done_markers,omitempty"`
+
+	IncludePatterns []string `yaml:"include_patterns,omitempty"`
+	ExcludePatterns []string `yaml:"exclude_patterns,omitempty"`
+	IncludeHidden   bool     `yaml:"include_hidden,omitempty"`
+	Order           string   `yaml:"order,omitempty"`
+	NameTimePattern string   `yaml:"name_time_pattern,omitempty"`
+	NameTimeLayout  string   `yaml:"name_time_layout,omitempty"`
+
+	ScanDepth        int  `yaml:"scan_depth,omitempty"`
+	CleanupEmptyDirs bool `yaml:"cleanup_empty_dirs,omitempty"`
+
+	ParallelFiles int `yaml:"parallel_files,omitempty"`
+	EncodeWorkers int `yaml:"encode_workers,omitempty"`
+
+	Watch bool `yaml:"watch,omitempty"`
+
+	SftpKeepaliveInterval int `yaml:"sftp_keepalive_interval,omitempty"`
+	SftpReconnectAttempts int `yaml:"sftp_reconnect_attempts,omitempty"`
+
+	SftpHostKeyCheck        string   `yaml:"sftp_host_key_check,omitempty"`
+	SftpKnownHosts          string   `yaml:"sftp_known_hosts,omitempty"`
+	SftpHostKeyFingerprints []string `yaml:"sftp_host_key_fingerprints,omitempty"`
+
+	PrivateKeyPassphrase secret.Value `yaml:"private_key_passphrase,omitempty"`
+	CertificatePath      string       `yaml:"certificate_path,omitempty"`
+	SftpAuthMethods      []string     `yaml:"sftp_auth_methods,omitempty"`
+
+	SftpPasswordFile         string `yaml:"sftp_password_file,omitempty"`
+	PrivateKeyPassphraseFile string `yaml:"private_key_passphrase_file,omitempty"`
+
+	SftpJumpHosts []jumpHost `yaml:"sftp_jump_hosts,omitempty"`
+
+	PostProcess       string `yaml:"post_process,omitempty"`
+	PostProcessSuffix string `yaml:"post_process_suffix,omitempty"`
+	ArchiveDir        string `yaml:"archive_dir,omitempty"`
+}
+
+// secretSetting is a secret setting of a source, which can also be read
+// from the file named by the setting with the _file suffix.
+type secretSetting struct {
+	key   string
+	value *secret.Value
+	file  *string
+}
+
+func (src *sourceConfig) secrets() []secretSetting {
+	return []secretSetting{
+		{"sftp_password", &src.SftpPassword, &src.SftpPasswordFile},
+		{"private_key_passphrase", &src.PrivateKeyPassphrase, &src.PrivateKeyPassphraseFile},
+	}
+}
+
+// resolveSecrets reads the secrets given as files.
+func (src *sourceConfig) resolveSecrets() error {
+	for _, s := range src.secrets() {
+		if err := s.value.Resolve(*s.file); err != nil {
+			return fmt.Errorf("%v: %v", s.key, err)
+		}
+	}
+	// The jump hosts may be shared with other sources.
+	jumps := make([]jumpHost, len(src.SftpJumpHosts))
+	copy(jumps, src.SftpJumpHosts)
+	for i := range jumps {
+		if err := jumps[i].resolveSecrets(); err != nil {
+			return fmt.Errorf("jump host %v: %v", jumps[i].Host, err)
+		}
+	}
+	src.SftpJumpHosts = jumps
+	return nil
+}
+
+// Source types.
+const (
+	sourceLocal = "local"
+	sourceSftp  = "sftp"
+)
+
 type FilesystemReader interface {
-	Read() ([]string, error)
+	// Next opens the next file to read, waiting for one if there is none.
+	Next(ctx context.Context) (*inputFile, error)
+	// Ack marks the records of a file up to the given one as done with,
+	// whether they were published or skipped, so that they are not read
+	// again after a restart.
+	Ack(f *inputFile, line int)
+	// Reject marks a record as done with but not published.
+	Reject(f *inputFile, line int)
+	// Drain marks a file whose reading is over, and whose last records
+	// are being published.
+	Drain(f *inputFile)
+	// Finish closes a file whose records are all done with, or whose
+	// reading failed with err, and post-processes it.
+	Finish(f *inputFile, err error)
+	Close() error
 }
 
 func loadConfig(path string) (*config, error) {
@@ -43,9 +180,24 @@ func loadConfig(path string) (*config, error) {
 	cfg.SftpEnabled = false
 	cfg.SftpIp = "127.0.0.1"
 	cfg.SftpPort = "22"
-	cfg.SftpUser = "osboxes"
-	cfg.SftpPassword = "osboxes.org"
-	cfg.PrivateKeyPath = "/home/osboxes/.ssh/id_rsa"
+	cfg.RecordName = "hits"
+	cfg.TimeZone = "UTC"
+	cfg.CheckpointFile = "checkpoints.json"
+	cfg.CheckpointTopic = "csv2kafka-checkpoints"
+	cfg.CheckpointInterval = 1000
+	cfg.FileRegistry = "files.json"
+	cfg.DuplicateRetentionDays = 30
+	cfg.MaxFileAttempts = 3
+	cfg.Order = orderName
+	cfg.NameTimePattern = `(\d{14})`
+	cfg.NameTimeLayout = "20060102150405"
+	cfg.ParallelFiles = 1
+	cfg.EncodeWorkers = 1
+	cfg.Watch = true
+	cfg.SftpKeepaliveInterval = 30
+	cfg.SftpReconnectAttempts = 5
+	cfg.PostProcess = postProcessMove
+	cfg.PostProcessSuffix = ".done"
 
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -55,9 +207,100 @@ func loadConfig(path string) (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = loadSources(cfg, content)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg.Sources {
+		if err := cfg.Sources[i].resolveSecrets(); err != nil {
+			return nil, fmt.Errorf("source %v: %v", cfg.Sources[i].Name, err)
+		}
+	}
+	if len(cfg.Sources) == 0 {
+		if err := cfg.sourceConfig.resolveSecrets(); err != nil {
+			return nil, err
+		}
+	}
 	return cfg, nil
 }
 
+// loadSources decodes the sources list again, this time over copies of the
+// top-level source settings, so that those serve as defaults.
+func loadSources(cfg *config, content []byte) error {
+	if len(cfg.Sources) == 0 {
+		return nil
+	}
+	var raw struct {
+		Sources []yaml.MapSlice `yaml:"sources"`
+	}
+	err := yaml.Unmarshal(content, &raw)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i, item := range raw.Sources {
+		b, err := yaml.Marshal(item)
+		if err != nil {
+			return err
+		}
+		src := cfg.sourceConfig
+		src.Name = ""
+		// A secret set by the source replaces the top-level one,
+		// whether either is given as a value or as a file.
+		for _, s := range src.secrets() {
+			if hasKey(item, s.key) || hasKey(item, s.key+"_file") {
+				*s.value = ""
+				*s.file = ""
+			}
+		}
+		err = yaml.Unmarshal(b, &src)
+		if err != nil {
+			return fmt.Errorf("source %d: %v", i, err)
+		}
+		if src.Name == "" {
+			src.Name = fmt.Sprintf("source%d", i)
+		}
+		if names[src.Name] {
+			return fmt.Errorf("duplicate source name %v", src.Name)
+		}
+		names[src.Name] = true
+		cfg.Sources[i] = src
+	}
+	return nil
+}
+
+func hasKey(m yaml.MapSlice, key string) bool {
+	for _, item := range m {
+		if item.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sources returns the configured sources, or the top-level one if there is
+// no sources list.
+func (cfg *config) sources() []sourceConfig {
+	if len(cfg.Sources) > 0 {
+		return cfg.Sources
+	}
+	return []sourceConfig{cfg.sourceConfig}
+}
+
+// sourceType returns local or sftp, honouring the older sftp_enabled flag.
+func (src *sourceConfig) sourceType() (string, error) {
+	switch src.Type {
+	case "":
+		if src.SftpEnabled {
+			return sourceSftp, nil
+		}
+		return sourceLocal, nil
+	case sourceLocal, sourceSftp:
+		return src.Type, nil
+	}
+	return "", fmt.Errorf("unknown source type %q", src.Type)
+}
+
 // Abstract Entities
 //
 // We are dealing with at least two abstractions: data source and encoding.
@@ -80,27 +323,100 @@ type FileReader struct {
 }
 
 // NewFilesystemReader is a factory method that instantiates the right reader
-// as per passed configuration.
-func NewFilesystemReader(cfg *config) (FilesystemReader, error) {
-	if cfg.SftpEnabled {
-		return &SftpFilesystemReader{
-			inputDir:       cfg.InputDir,
-			readyDir:       cfg.ReadyDir,
-			waitInterval:   cfg.WaitInterval,
-			ip:             cfg.SftpIp,
-			port:           cfg.SftpPort,
-			user:           cfg.SftpUser,
-			password:       cfg.SftpPassword,
-			privateKeyPath: cfg.PrivateKeyPath,
-			index:          -1,
-		}, nil
+// as per passed configuration. Once ctx is done, remote readers stop trying
+// to reconnect.
+func NewFilesystemReader(ctx context.Context, cfg *sourceConfig, checkpoints checkpointStore, registry *fileRegistry) (FilesystemReader, error) {
+	sourceType, err := cfg.sourceType()
+	if err != nil {
+		return nil, err
+	}
+	selection, err := newSelection(cfg)
+	if err != nil {
+		return nil, err
+	}
+	post, err := newPostProcessing(cfg, checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	stableFor := cfg.StableSeconds
+	if stableFor == 0 {
+		stableFor = cfg.WaitInterval
+	}
+	dr := &dirReader{
+		source:             cfg.Name,
+		inputDir:           cfg.InputDir,
+		readyDir:           cfg.ReadyDir,
+		waitInterval:       cfg.WaitInterval,
+		checkpoints:        checkpoints,
+		checkpointInterval: cfg.CheckpointInterval,
+		duplicateDir:       cfg.DuplicateDir,
+		errorDir:           cfg.ErrorDir,
+		maxAttempts:        cfg.MaxFileAttempts,
+		maxRejectedRatio:   cfg.MaxRejectedRatio,
+		scanDepth:          cfg.ScanDepth,
+		cleanupDirs:        cfg.CleanupEmptyDirs,
+		selection:          selection,
+		post:               post,
+		watcher:            pollWatcher{},
+		completion: completion{
+			ignore:    cfg.IgnorePatterns,
+			minAge:    time.Duration(cfg.MinFileAge) * time.Second,
+			stable:    cfg.RequireStable,
+			stableFor: time.Duration(stableFor) * time.Second,
+			markers:   cfg.DoneMarkers,
+		},
+	}
+	if cfg.DuplicateDir != "" {
+		dr.registry = registry
+	}
+	if sourceType == sourceSftp {
+		hostKeyCallback, err := newHostKeyCallback(cfg.SftpIp, cfg.SftpHostKeyCheck, cfg.SftpKnownHosts, cfg.SftpHostKeyFingerprints)
+		if err != nil {
+			return nil, fmt.Errorf("sftp host key: %v", err)
+		}
+		auth, err := newSSHAuth(sshCredentials{
+			User:                 cfg.SftpUser,
+			Password:             string(cfg.SftpPassword),
+			PrivateKeyPath:       cfg.PrivateKeyPath,
+			PrivateKeyPassphrase: string(cfg.PrivateKeyPassphrase),
+			CertificatePath:      cfg.CertificatePath,
+			AuthMethods:          cfg.SftpAuthMethods,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("sftp auth: %v", err)
+		}
+		jumps, err := newSSHHops(cfg.SftpJumpHosts)
+		if err != nil {
+			return nil, err
+		}
+		r := &SftpFilesystemReader{
+			dirReader: dr,
+			ctx:       ctx,
+			ip:        cfg.SftpIp,
+			port:      cfg.SftpPort,
+
+			auth:              auth,
+			hostKeyCallback:   hostKeyCallback,
+			jumps:             jumps,
+			keepaliveInterval: time.Duration(cfg.SftpKeepaliveInterval) * time.Second,
+			reconnectAttempts: cfg.SftpReconnectAttempts,
+		}
+		if r.reconnectAttempts < 1 {
+			r.reconnectAttempts = 1
+		}
+		r.fs = r
+		return r, nil
 	} else {
-		return &LocalFilesystemReader{
-			inputDir:     cfg.InputDir,
-			readyDir:     cfg.ReadyDir,
-			waitInterval: cfg.WaitInterval,
-			index:        -1,
-		}, nil
+		dr.fs = localFileSystem{}
+		if cfg.Watch {
+			w, err := newWatcher()
+			if err != nil {
+				log.Printf("Not watching %v, polling it instead: %v", cfg.InputDir, err)
+			} else {
+				dr.watcher = w
+			}
+		}
+		return &LocalFilesystemReader{dirReader: dr}, nil
 	}
 }
 
@@ -127,32 +443,180 @@ type KafkaWriter struct {
 	topic    string
 	writer   *kafka.Producer
 	delivery chan kafka.Event
+
+	// transactional is set when writes are grouped into transactions,
+	// which are begun by the first write after a commit.
+	transactional bool
+	inTransaction bool
+	// failed is the error that made the writer abort a transaction.
+	// The aborted records are not covered by a checkpoint, so nothing
+	// more is written, to resume from the last committed checkpoint
+	// after a restart.
+	failed error
 }
 
-func NewKafkaWriter(cfg *config) (*KafkaWriter, error) {
+func NewKafkaWriter(cfg *config, transactionalID string) (*KafkaWriter, error) {
 	var brokers = cfg.KafkaBrokers
 
-	w, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": brokers})
+	conf := kafka.ConfigMap{"bootstrap.servers": brokers}
+	if transactionalID != "" {
+		conf["transactional.id"] = transactionalID
+	}
+	w, err := kafka.NewProducer(&conf)
 	if err != nil {
 		return nil, err
 	}
 	k := KafkaWriter{
-		topic:    cfg.KafkaTopic,
-		writer:   w,
-		delivery: make(chan kafka.Event),
+		topic:         cfg.KafkaTopic,
+		writer:        w,
+		delivery:      make(chan kafka.Event),
+		transactional: transactionalID != "",
+	}
+	if k.transactional {
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeoutMs*time.Millisecond)
+		defer cancel()
+		if err := w.InitTransactions(ctx); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("initialising transactions: %v", err)
+		}
 	}
 	return &k, nil
 }
 
 func (w *KafkaWriter) Write(p []byte) (int, error) {
-	var topic = w.topic
-	_ = w.writer.Produce(&kafka.Message{
+	return w.WriteTo(w.topic, p)
+}
+
+// WriteTo writes p to the given topic instead of the writer's own.
+func (w *KafkaWriter) WriteTo(topic string, p []byte) (int, error) {
+	return 0, w.produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
 		Value:          p,
-	}, w.delivery)
+	})
+}
+
+// WriteAsync produces p to the given topic without waiting for its
+// delivery, whose report is sent to delivered.
+func (w *KafkaWriter) WriteAsync(topic string, p []byte, delivered chan kafka.Event) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	return w.writer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          p,
+	}, delivered)
+}
+
+func (w *KafkaWriter) produce(m *kafka.Message) error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	_ = w.writer.Produce(m, w.delivery)
 	e := <-w.delivery
-	m := e.(*kafka.Message)
-	return 0, m.TopicPartition.Error
+	m = e.(*kafka.Message)
+	return m.TopicPartition.Error
+}
+
+func (w *KafkaWriter) begin() error {
+	if w.failed != nil {
+		return w.failed
+	}
+	if !w.transactional || w.inTransaction {
+		return nil
+	}
+	if err := w.writer.BeginTransaction(); err != nil {
+		return err
+	}
+	w.inTransaction = true
+	return nil
+}
+
+// Delays between retries of a transaction commit, which double from
+// commitRetryMinDelay up to commitRetryMaxDelay.
+const (
+	commitRetryMinDelay = 100 * time.Millisecond
+	commitRetryMaxDelay = 2 * time.Second
+)
+
+// Commit commits the current transaction, if any. A transaction that fails
+// to commit is aborted.
+func (w *KafkaWriter) Commit() error {
+	if !w.inTransaction {
+		return nil
+	}
+	w.inTransaction = false
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeoutMs*time.Millisecond)
+	defer cancel()
+	err := w.writer.CommitTransaction(ctx)
+	delay := commitRetryMinDelay
+	for isRetriable(err) {
+		log.Printf("Failed to commit transaction: %v, retrying in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		err = w.writer.CommitTransaction(ctx)
+		if delay *= 2; delay > commitRetryMaxDelay {
+			delay = commitRetryMaxDelay
+		}
+	}
+	if err != nil {
+		// ctx may have expired retrying the commit.
+		abortCtx, cancel := context.WithTimeout(context.Background(), kafkaTimeoutMs*time.Millisecond)
+		defer cancel()
+		if abortErr := w.writer.AbortTransaction(abortCtx); abortErr != nil {
+			log.Println("Failed to abort transaction", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func isRetriable(err error) bool {
+	kerr, ok := err.(kafka.Error)
+	return ok && kerr.IsRetriable()
+}
+
+// Close aborts the current transaction, whose records are not covered by a
+// checkpoint, and closes the producer after waiting up to timeout for the
+// delivery of the messages still in flight.
+func (w *KafkaWriter) Close(timeout time.Duration) error {
+	var err error
+	if w.inTransaction {
+		log.Println("Aborting uncommitted transaction")
+		err = w.Abort()
+	}
+	if n := w.writer.Flush(int(timeout / time.Millisecond)); n > 0 && err == nil {
+		err = fmt.Errorf("%d messages not delivered", n)
+	}
+	w.writer.Close()
+	return err
+}
+
+// fail aborts the current transaction after err, and stops writing.
+func (w *KafkaWriter) fail(err error) error {
+	if abortErr := w.Abort(); abortErr != nil {
+		log.Println("Failed to abort transaction", abortErr)
+	}
+	if w.failed == nil {
+		w.failed = err
+	}
+	return w.failed
+}
+
+// Abort aborts the current transaction, if any, so that read_committed
+// consumers never see its messages.
+func (w *KafkaWriter) Abort() error {
+	if !w.inTransaction {
+		return nil
+	}
+	w.inTransaction = false
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeoutMs*time.Millisecond)
+	defer cancel()
+	return w.writer.AbortTransaction(ctx)
 }
 
 type AvroCodec struct {
@@ -206,8 +670,109 @@ func (c *AvroCodec) TextualFromBinary(binary []byte) {
 	fmt.Println(string(textual))
 }
 
-func recordFactory() Record {
-	return &hitsRecord{}
+// recordFactory returns the record described by the mapping setting, or the
+// built-in hits record if there is none.
+func recordFactory(cfg *sourceConfig) (Record, error) {
+	if len(cfg.Mapping) == 0 {
+		return &hitsRecord{}, nil
+	}
+	return newMappedRecord(cfg.RecordName, cfg.Mapping, cfg.TimeZone)
+}
+
+// Exit statuses: exitShutdownFailed if a source failed or messages may have
+// been lost while shutting down, exitInterrupted if a second signal cut the
+// shutdown short.
+const (
+	exitShutdownFailed = 1
+	exitInterrupted    = 130
+)
+
+// flushTimeout bounds the wait for the delivery of the messages in flight
+// when shutting down.
+const flushTimeout = 10 * time.Second
+
+// source is an input directory being read and published from.
+type source struct {
+	name   string
+	reader FilesystemReader
+	router *recordRouter
+	writer *KafkaWriter
+	// checkpoints is set if the source has its own checkpoint store, and
+	// resumable if its files are checkpointed at all.
+	checkpoints checkpointStore
+	resumable   bool
+
+	parallelFiles int
+	encodeWorkers int
+}
+
+func newSource(ctx context.Context, cfg *config, src *sourceConfig, checkpoints checkpointStore, registry *fileRegistry) (*source, error) {
+	router, err := newRecordRouter(src)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up record mapping: %v", err)
+	}
+	transactionalID := cfg.TransactionalID
+	if transactionalID != "" && len(cfg.Sources) > 0 {
+		// Each source commits its own transactions.
+		transactionalID += "-" + src.Name
+	}
+	writer, err := NewKafkaWriter(cfg, transactionalID)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Kafka writer: %v", err)
+	}
+	var own checkpointStore
+	if writer.transactional || cfg.CheckpointStore == "kafka" {
+		own, err = newCheckpointStore(cfg, writer)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up checkpoints: %v", err)
+		}
+		checkpoints = own
+	}
+	reader, err := NewFilesystemReader(ctx, src, checkpoints, registry)
+	if err != nil {
+		return nil, fmt.Errorf("could not open dir for reading: %v", err)
+	}
+	s := &source{
+		name:          src.Name,
+		reader:        reader,
+		router:        router,
+		writer:        writer,
+		checkpoints:   own,
+		resumable:     checkpoints != nil,
+		parallelFiles: src.ParallelFiles,
+		encodeWorkers: src.EncodeWorkers,
+	}
+	if s.parallelFiles < 1 {
+		s.parallelFiles = 1
+	}
+	if s.encodeWorkers < 1 {
+		s.encodeWorkers = 1
+	}
+	if writer.transactional && s.parallelFiles > 1 {
+		// A commit covers all records produced so far, so it must
+		// not include those of other files than the checkpointed one.
+		log.Printf("Source %v: reading one file at a time in transactional mode", src.Name)
+		s.parallelFiles = 1
+	}
+	return s, nil
+}
+
+// close flushes the source's writer and releases its reader and checkpoint
+// store, once it has stopped running.
+func (s *source) close() error {
+	err := s.writer.Close(flushTimeout)
+	if err != nil {
+		err = fmt.Errorf("could not flush Kafka writer: %v", err)
+	}
+	if err2 := s.reader.Close(); err2 != nil {
+		log.Printf("Source %v: could not close reader: %v", s.name, err2)
+	}
+	if s.checkpoints != nil {
+		if err2 := s.checkpoints.Close(); err2 != nil && err == nil {
+			err = fmt.Errorf("could not close checkpoints: %v", err2)
+		}
+	}
+	return err
 }
 
 func main() {
@@ -218,43 +783,78 @@ func main() {
 	if err != nil {
 		log.Fatalf("config %v", err)
 	}
-
-	var data2 = recordFactory()
-	var schema = data2.getSchema()
-	codec, err := NewAvroCodec(schema)
-	if err != nil {
-		log.Fatalln("Could not parse schema", err)
+	if effective, err := yaml.Marshal(cfg); err == nil {
+		log.Printf("Effective config:\n%s", effective)
 	}
 
-	writer, err := NewKafkaWriter(cfg)
-	if err != nil {
-		log.Fatal("Could not create Kafka writer")
+	// File based checkpoints and the file registry are shared by all
+	// sources; Kafka based checkpoints are kept per source.
+	var checkpoints checkpointStore
+	if cfg.CheckpointStore != "kafka" && cfg.TransactionalID == "" {
+		checkpoints, err = newCheckpointStore(cfg, nil)
+		if err != nil {
+			log.Fatalln("Could not set up checkpoints", err)
+		}
 	}
-	recordReader, err := NewFilesystemReader(cfg)
+	retention := time.Duration(cfg.DuplicateRetentionDays) * 24 * time.Hour
+	registry, err := newFileRegistry(cfg.FileRegistry, retention)
 	if err != nil {
-		log.Fatal("Could not open dir for reading")
+		log.Fatalln("Could not load file registry", err)
 	}
-	for {
-		record, err := recordReader.Read()
-		if err != nil {
-			log.Println("Skipping record due to error", err)
-			continue
-		}
-		data2.unmarshalFromCSV(record)
-		binary, err := codec.BinaryFromNative(data2.toStringMap())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var sources []*source
+	for i := range cfg.sources() {
+		src := &cfg.sources()[i]
+		s, err := newSource(ctx, cfg, src, checkpoints, registry)
 		if err != nil {
-			// XXX/PDP Audit this error message. It usually
-			// denotes receiving a record that does not have a
-			// mandatory field.
-			log.Println("Could not convert to binary", err)
-			continue
+			log.Fatalf("Source %v: %v", src.Name, err)
 		}
+		sources = append(sources, s)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		cancel()
+		sig = <-signals
+		log.Printf("Received %v again, exiting immediately", sig)
+		os.Exit(exitInterrupted)
+	}()
 
-		// codec.TextualFromBinary(binary)
-		_, err = writer.Write(binary)
+	var wg sync.WaitGroup
+	errs := make([]error, len(sources))
+	for i, s := range sources {
+		wg.Add(1)
+		go func(i int, s *source) {
+			defer wg.Done()
+			errs[i] = s.run(ctx, cancel)
+		}(i, s)
+	}
+	wg.Wait()
+
+	status := 0
+	for i, err := range errs {
 		if err != nil {
-			log.Println("Error when writing to Kafka", err)
+			log.Printf("Source %v failed: %v", sources[i].name, err)
+			status = exitShutdownFailed
+		}
+	}
+	for _, s := range sources {
+		if err := s.close(); err != nil {
+			log.Printf("Source %v: %v", s.name, err)
+			status = exitShutdownFailed
+		}
+	}
+	if checkpoints != nil {
+		if err := checkpoints.Close(); err != nil {
+			log.Println("Failed to close checkpoints", err)
+			status = exitShutdownFailed
 		}
 	}
+	log.Println("Shut down")
+	os.Exit(status)
 	// Web: https://github.com/linkedin/goavro/issues/121
 }
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// defaultTimeLayout is the layout of the time columns in the hits files.
+const defaultTimeLayout = "01/02/2006 15:04:05"
+
+// Pseudo layouts for time columns holding a Unix epoch offset rather than a
+// formatted time.
+const (
+	layoutEpochSeconds = "epoch_seconds"
+	layoutEpochMillis  = "epoch_millis"
+)
+
+// Avro types with a logical type that mapped fields can be converted to.
+const (
+	typeTimestampMillis = "timestamp-millis"
+	typeTimestampMicros = "timestamp-micros"
+	typeDate            = "date"
+	typeDecimal         = "decimal"
+)
+
+// Encodings of bytes and fixed columns.
+const (
+	encodingText   = "text"
+	encodingHex    = "hex"
+	encodingBase64 = "base64"
+	encodingIP     = "ip"
+)
+
+var avroNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// fieldMapping describes how a CSV column is converted to an Avro field.
+//
+// Time columns are parsed with the first of Layouts that matches, in the
+// field's TimeZone or else the record's. They are emitted either as Avro
+// logical types, or for plain long and int fields as seconds since the
+// epoch, which is what the built-in hits record does.
+//
+// Arrays and maps are split out of a single column, with Items and Values
+// describing the type of their elements. Records group several columns,
+// each described by one of Fields, into a nested record.
+type fieldMapping struct {
+	Name     string   `yaml:"name"`
+	Column   *int     `yaml:"column,omitempty"`
+	Type     string   `yaml:"type"`
+	Required bool     `yaml:"required,omitempty"`
+	Layouts  []string `yaml:"layouts,omitempty"`
+	TimeZone string   `yaml:"time_zone,omitempty"`
+
+	// TypeName names enum, fixed and record types; it defaults to Name.
+	TypeName  string         `yaml:"type_name,omitempty"`
+	Precision int            `yaml:"precision,omitempty"`
+	Scale     int            `yaml:"scale,omitempty"`
+	Encoding  string         `yaml:"encoding,omitempty"`
+	Size      int            `yaml:"size,omitempty"`
+	Symbols   []string       `yaml:"symbols,omitempty"`
+	Items     *fieldMapping  `yaml:"items,omitempty"`
+	Values    *fieldMapping  `yaml:"values,omitempty"`
+	Delimiter string         `yaml:"delimiter,omitempty"`
+	Separator string         `yaml:"separator,omitempty"`
+	Fields    []fieldMapping `yaml:"fields,omitempty"`
+
+	column   int
+	location *time.Location
+	convert  func(string) (interface{}, error)
+	// unionName is the name goavro uses for the type in a union.
+	unionName string
+	// schema is the Avro type of the field, without the null branch.
+	schema interface{}
+}
+
+// mappedRecord is a Record whose columns and schema are defined by the
+// mapping setting rather than in code.
+type mappedRecord struct {
+	name   string
+	fields []fieldMapping
+	values []string
+}
+
+func newMappedRecord(name string, fields []fieldMapping, timeZone string) (*mappedRecord, error) {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("time zone: %v", err)
+	}
+	r := &mappedRecord{name: name}
+	r.fields, err = compileFields(fields, 0, loc)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// compileFields prepares a copy of fields for conversion. Fields without a
+// column take the one at their position counted from firstColumn.
+func compileFields(fields []fieldMapping, firstColumn int, loc *time.Location) ([]fieldMapping, error) {
+	compiled := make([]fieldMapping, len(fields))
+	copy(compiled, fields)
+	for i := range compiled {
+		f := &compiled[i]
+		if f.Name == "" {
+			return nil, fmt.Errorf("mapping %d has no name", i)
+		}
+		f.column = firstColumn + i
+		if f.Column != nil {
+			f.column = *f.Column
+		}
+		if err := f.compile(loc); err != nil {
+			return nil, fmt.Errorf("field %v: %v", f.Name, err)
+		}
+	}
+	return compiled, nil
+}
+
+// compile sets up the conversion function and schema for the field's type.
+func (f *fieldMapping) compile(loc *time.Location) error {
+	f.location = loc
+	if f.TimeZone != "" {
+		var err error
+		f.location, err = time.LoadLocation(f.TimeZone)
+		if err != nil {
+			return fmt.Errorf("time zone: %v", err)
+		}
+	}
+	if f.TypeName == "" {
+		f.TypeName = f.Name
+	}
+	timeColumn := len(f.Layouts) > 0
+	if !timeColumn {
+		f.Layouts = []string{defaultTimeLayout}
+	}
+	f.unionName = f.Type
+	f.schema = f.Type
+	switch f.Type {
+	case "string":
+		f.convert = func(s string) (interface{}, error) { return s, nil }
+	case "long", "int":
+		bits := 64
+		if f.Type == "int" {
+			bits = 32
+		}
+		f.convert = func(s string) (interface{}, error) {
+			var v int64
+			var err error
+			if timeColumn {
+				// Time columns stored as seconds since the epoch.
+				var t time.Time
+				t, err = f.parseTime(s)
+				v = t.Unix()
+			} else {
+				v, err = strconv.ParseInt(strings.TrimSpace(s), 10, bits)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if bits == 32 {
+				return int32(v), nil
+			}
+			return v, nil
+		}
+	case "float", "double":
+		bits := 64
+		if f.Type == "float" {
+			bits = 32
+		}
+		f.convert = func(s string) (interface{}, error) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), bits)
+			if err != nil {
+				return nil, err
+			}
+			if bits == 32 {
+				return float32(v), nil
+			}
+			return v, nil
+		}
+	case "boolean":
+		f.convert = parseBoolean
+	case typeTimestampMillis, typeTimestampMicros:
+		f.unionName = "long." + f.Type
+		f.schema = map[string]interface{}{"type": "long", "logicalType": f.Type}
+		f.convert = func(s string) (interface{}, error) { return f.parseTime(s) }
+	case typeDate:
+		f.unionName = "int." + f.Type
+		f.schema = map[string]interface{}{"type": "int", "logicalType": f.Type}
+		f.convert = func(s string) (interface{}, error) {
+			t, err := f.parseTime(s)
+			if err != nil {
+				return nil, err
+			}
+			// goavro counts days from the UTC instant, so keep the
+			// calendar date of the source time zone.
+			y, m, d := t.Date()
+			return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), nil
+		}
+	case typeDecimal:
+		return f.compileDecimal()
+	case "bytes", "fixed":
+		return f.compileBytes()
+	case "enum":
+		return f.compileEnum()
+	case "array", "map":
+		return f.compileCollection()
+	case "record":
+		return f.compileRecord(loc)
+	default:
+		return fmt.Errorf("unsupported type %q", f.Type)
+	}
+	return nil
+}
+
+// compileDecimal sets up a decimal logical type stored as bytes. Values with
+// more digits than the precision or more decimal places than the scale are
+// rejected rather than rounded.
+func (f *fieldMapping) compileDecimal() error {
+	if f.Precision < 1 || f.Scale < 0 || f.Scale > f.Precision {
+		return fmt.Errorf("decimal needs a precision of at least 1 and a scale between 0 and the precision")
+	}
+	f.unionName = "bytes.decimal"
+	f.schema = map[string]interface{}{
+		"type":        "bytes",
+		"logicalType": typeDecimal,
+		"precision":   f.Precision,
+		"scale":       f.Scale,
+	}
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(f.Scale)), nil))
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(f.Precision)), nil)
+	f.convert = func(s string) (interface{}, error) {
+		r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+		if !ok {
+			return nil, fmt.Errorf("invalid decimal %q", s)
+		}
+		unscaled := new(big.Rat).Mul(r, scale)
+		if !unscaled.IsInt() {
+			return nil, fmt.Errorf("%q has more than %d decimal places", s, f.Scale)
+		}
+		if new(big.Int).Abs(unscaled.Num()).Cmp(limit) >= 0 {
+			return nil, fmt.Errorf("%q has more than %d digits", s, f.Precision)
+		}
+		return r, nil
+	}
+	return nil
+}
+
+// compileBytes sets up bytes and fixed fields. The column is decoded
+// according to Encoding; ip gives the 4 byte form of IPv4 addresses and the
+// 16 byte form of IPv6 ones, or always the 16 byte form for a fixed of that
+// size.
+func (f *fieldMapping) compileBytes() error {
+	var decode func(string) ([]byte, error)
+	switch f.Encoding {
+	case "", encodingText:
+		decode = func(s string) ([]byte, error) { return []byte(s), nil }
+	case encodingHex:
+		decode = func(s string) ([]byte, error) { return hex.DecodeString(strings.TrimSpace(s)) }
+	case encodingBase64:
+		decode = func(s string) ([]byte, error) { return base64.StdEncoding.DecodeString(strings.TrimSpace(s)) }
+	case encodingIP:
+		decode = func(s string) ([]byte, error) { return parseIP(s, f.Size) }
+	default:
+		return fmt.Errorf("unknown encoding %q", f.Encoding)
+	}
+	if f.Type == "bytes" {
+		f.convert = func(s string) (interface{}, error) { return decode(s) }
+		return nil
+	}
+	if f.Size < 1 {
+		return fmt.Errorf("fixed needs a size")
+	}
+	if f.Encoding == encodingIP && f.Size != net.IPv4len && f.Size != net.IPv6len {
+		return fmt.Errorf("fixed IP addresses must have size %d or %d", net.IPv4len, net.IPv6len)
+	}
+	if err := f.setTypeName(); err != nil {
+		return err
+	}
+	f.schema = map[string]interface{}{"type": "fixed", "name": f.TypeName, "size": f.Size}
+	f.convert = func(s string) (interface{}, error) {
+		b, err := decode(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != f.Size {
+			return nil, fmt.Errorf("%q is %d bytes instead of %d", s, len(b), f.Size)
+		}
+		return b, nil
+	}
+	return nil
+}
+
+func (f *fieldMapping) compileEnum() error {
+	if len(f.Symbols) == 0 {
+		return fmt.Errorf("enum needs symbols")
+	}
+	symbols := make(map[string]bool, len(f.Symbols))
+	for _, s := range f.Symbols {
+		if !avroNameRe.MatchString(s) {
+			return fmt.Errorf("invalid enum symbol %q", s)
+		}
+		symbols[s] = true
+	}
+	if err := f.setTypeName(); err != nil {
+		return err
+	}
+	f.schema = map[string]interface{}{"type": "enum", "name": f.TypeName, "symbols": f.Symbols}
+	f.convert = func(s string) (interface{}, error) {
+		s = strings.TrimSpace(s)
+		if !symbols[s] {
+			return nil, fmt.Errorf("%q is not one of the symbols %q", s, f.Symbols)
+		}
+		return s, nil
+	}
+	return nil
+}
+
+// compileCollection sets up an array split on Delimiter (default "|") or a
+// map of key/value pairs split on Delimiter (default ";") with keys and
+// values separated by Separator (default "="). Empty elements are skipped.
+// Elements default to the field's time zone.
+func (f *fieldMapping) compileCollection() error {
+	elem := f.Items
+	key := "items"
+	if f.Type == "map" {
+		elem = f.Values
+		key = "values"
+	}
+	if elem == nil {
+		return fmt.Errorf("%v needs %v", f.Type, key)
+	}
+	copied := *elem
+	elem = &copied
+	if elem.Name == "" {
+		elem.Name = f.Name + "_" + key
+	}
+	if err := elem.compile(f.location); err != nil {
+		return fmt.Errorf("%v: %v", key, err)
+	}
+	if elem.convert == nil {
+		return fmt.Errorf("%v: %v elements cannot be split from a column", key, elem.Type)
+	}
+	f.schema = map[string]interface{}{"type": f.Type, key: elem.schema}
+	if f.Type == "array" {
+		if f.Delimiter == "" {
+			f.Delimiter = "|"
+		}
+		f.convert = func(s string) (interface{}, error) {
+			items := []interface{}{}
+			for _, part := range strings.Split(s, f.Delimiter) {
+				if strings.TrimSpace(part) == "" {
+					continue
+				}
+				v, err := elem.convert(part)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, v)
+			}
+			return items, nil
+		}
+		return nil
+	}
+	if f.Delimiter == "" {
+		f.Delimiter = ";"
+	}
+	if f.Separator == "" {
+		f.Separator = "="
+	}
+	f.convert = func(s string) (interface{}, error) {
+		m := make(map[string]interface{})
+		for _, part := range strings.Split(s, f.Delimiter) {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			kv := strings.SplitN(part, f.Separator, 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("%q is not a key%svalue pair", part, f.Separator)
+			}
+			v, err := elem.convert(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			m[strings.TrimSpace(kv[0])] = v
+		}
+		return m, nil
+	}
+	return nil
+}
+
+// compileRecord sets up a nested record built from a group of columns. The
+// nested fields' columns default to consecutive columns starting at the
+// record's own column.
+func (f *fieldMapping) compileRecord(loc *time.Location) error {
+	if len(f.Fields) == 0 {
+		return fmt.Errorf("record needs fields")
+	}
+	if err := f.setTypeName(); err != nil {
+		return err
+	}
+	var err error
+	f.Fields, err = compileFields(f.Fields, f.column, f.location)
+	if err != nil {
+		return err
+	}
+	f.schema = recordSchema(f.TypeName, f.Fields)
+	return nil
+}
+
+func (f *fieldMapping) setTypeName() error {
+	if !avroNameRe.MatchString(f.TypeName) {
+		return fmt.Errorf("invalid type name %q", f.TypeName)
+	}
+	f.unionName = f.TypeName
+	return nil
+}
+
+func (f *fieldMapping) parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	var err error
+	for _, layout := range f.Layouts {
+		var t time.Time
+		switch layout {
+		case layoutEpochSeconds, layoutEpochMillis:
+			var v int64
+			v, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				continue
+			}
+			if layout == layoutEpochSeconds {
+				t = time.Unix(v, 0)
+			} else {
+				t = time.Unix(0, v*int64(time.Millisecond))
+			}
+			return t.In(f.location), nil
+		default:
+			t, err = time.ParseInLocation(layout, s, f.location)
+			if err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q matches none of the layouts %q: %v", s, f.Layouts, err)
+}
+
+// value converts the field's column, or columns for a record, of row. A nil
+// value means null.
+func (f *fieldMapping) value(row []string) (interface{}, error) {
+	if f.Type == "record" {
+		datum, set := recordDatum(f.Fields, row)
+		if !set {
+			return nil, nil
+		}
+		return datum, nil
+	}
+	if f.column >= len(row) || row[f.column] == "" {
+		return nil, nil
+	}
+	return f.convert(row[f.column])
+}
+
+// recordDatum converts row into the native form of a record with the given
+// fields. Empty or unparsable values become null; for required fields they
+// are left out so that the encoder rejects the record. It reports whether
+// any field had a value.
+func recordDatum(fields []fieldMapping, row []string) (map[string]interface{}, bool) {
+	datum := make(map[string]interface{}, len(fields))
+	set := false
+	for _, f := range fields {
+		v, err := f.value(row)
+		if err != nil {
+			log.Printf("Error parsing %v: %v\n", f.Name, err)
+			v = nil
+		}
+		switch {
+		case v == nil && f.Required:
+		case v == nil || f.Required:
+			datum[f.Name] = v
+		default:
+			datum[f.Name] = goavro.Union(f.unionName, v)
+		}
+		set = set || v != nil
+	}
+	return datum, set
+}
+
+func recordSchema(name string, fields []fieldMapping) map[string]interface{} {
+	schemaFields := make([]interface{}, 0, len(fields))
+	for _, f := range fields {
+		field := map[string]interface{}{"name": f.Name}
+		if f.Required {
+			field["type"] = f.schema
+		} else {
+			field["type"] = []interface{}{"null", f.schema}
+			field["default"] = nil
+		}
+		schemaFields = append(schemaFields, field)
+	}
+	return map[string]interface{}{
+		"type":   "record",
+		"name":   name,
+		"fields": schemaFields,
+	}
+}
+
+func (r *mappedRecord) getSchema() string {
+	schema, err := json.Marshal(recordSchema(r.name, r.fields))
+	if err != nil {
+		// Only plain strings, numbers and maps go into the schema.
+		panic(err)
+	}
+	return string(schema)
+}
+
+func (r *mappedRecord) clone() Record {
+	return &mappedRecord{name: r.name, fields: r.fields}
+}
+
+func (r *mappedRecord) unmarshalFromCSV(record []string) {
+	r.values = record
+}
+
+func (r *mappedRecord) toStringMap() map[string]interface{} {
+	datum, _ := recordDatum(r.fields, r.values)
+	return datum
+}
+
+func parseBoolean(s string) (interface{}, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "t", "true", "y", "yes":
+		return true, nil
+	case "0", "f", "false", "n", "no":
+		return false, nil
+	}
+	return nil, fmt.Errorf("invalid boolean %q", s)
+}
+
+// parseIP returns the 4 byte form of an IPv4 address and the 16 byte form of
+// an IPv6 one, unless size asks for the 16 byte form of both.
+func parseIP(s string, size int) ([]byte, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil && size != net.IPv6len {
+		return []byte(ip4), nil
+	}
+	if size == net.IPv4len {
+		return nil, fmt.Errorf("%q is not an IPv4 address", s)
+	}
+	return []byte(ip.To16()), nil
+}
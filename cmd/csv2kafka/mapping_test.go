@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFieldConvert(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		field fieldMapping
+		in    string
+		want  interface{}
+	}{
+		{fieldMapping{Type: "string"}, " a b ", " a b "},
+		{fieldMapping{Type: "long"}, " 2222200315 ", int64(2222200315)},
+		{fieldMapping{Type: "int"}, "-7", int32(-7)},
+		{fieldMapping{Type: "double"}, "1.25", 1.25},
+		{fieldMapping{Type: "float"}, "0.5", float32(0.5)},
+		{fieldMapping{Type: "boolean"}, "Yes", true},
+		{fieldMapping{Type: "boolean"}, "0", false},
+
+		// Time columns into plain longs are seconds since the epoch.
+		{fieldMapping{Type: "long", Layouts: []string{defaultTimeLayout}}, "07/06/2018 18:40:00", int64(1530902400)},
+		{fieldMapping{Type: "long", Layouts: []string{"2006-01-02"}, TimeZone: "Europe/Berlin"}, "2018-07-07", int64(1530914400)},
+		{fieldMapping{Type: "int", Layouts: []string{layoutEpochMillis}}, "1530902400000", int32(1530902400)},
+		{fieldMapping{Type: typeTimestampMillis, Layouts: []string{"2006-01-02", layoutEpochSeconds}}, "1530902400", time.Unix(1530902400, 0).UTC()},
+		{fieldMapping{Type: typeTimestampMicros, Layouts: []string{"2006-01-02 15:04"}, TimeZone: "Europe/Berlin"}, "2018-07-06 20:40", time.Date(2018, 7, 6, 20, 40, 0, 0, berlin)},
+		// Dates keep the calendar date of the source time zone.
+		{fieldMapping{Type: typeDate, Layouts: []string{layoutEpochSeconds}, TimeZone: "Europe/Berlin"}, "1530914400", time.Date(2018, 7, 7, 0, 0, 0, 0, time.UTC)},
+
+		{fieldMapping{Type: typeDecimal, Precision: 5, Scale: 2}, "123.4", big.NewRat(1234, 10)},
+		{fieldMapping{Type: typeDecimal, Precision: 3, Scale: 0}, "-999", big.NewRat(-999, 1)},
+
+		{fieldMapping{Type: "bytes"}, "ab", []byte("ab")},
+		{fieldMapping{Type: "bytes", Encoding: encodingHex}, "0aff", []byte{0x0a, 0xff}},
+		{fieldMapping{Type: "bytes", Encoding: encodingBase64}, "AQI=", []byte{1, 2}},
+		{fieldMapping{Type: "bytes", Encoding: encodingIP}, "10.0.0.1", []byte{10, 0, 0, 1}},
+		{fieldMapping{Type: "fixed", Size: 16, Encoding: encodingIP}, "10.0.0.1", []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1}},
+		{fieldMapping{Type: "fixed", Size: 2, Encoding: encodingHex}, "0102", []byte{1, 2}},
+		{fieldMapping{Type: "enum", Symbols: []string{"IN", "OUT"}}, " OUT ", "OUT"},
+
+		{fieldMapping{Type: "array", Items: &fieldMapping{Type: "long"}}, "1||2|", []interface{}{int64(1), int64(2)}},
+		{fieldMapping{Type: "array", Delimiter: ",", Items: &fieldMapping{Type: "string"}}, "a,b", []interface{}{"a", "b"}},
+		// Elements take the time zone of their collection.
+		{fieldMapping{Type: "array", TimeZone: "Europe/Berlin", Items: &fieldMapping{Type: "long", Layouts: []string{"2006-01-02"}}}, "2018-07-07", []interface{}{int64(1530914400)}},
+		{fieldMapping{Type: "map", Values: &fieldMapping{Type: "int"}}, "a=1; b = 2;", map[string]interface{}{"a": int32(1), "b": int32(2)}},
+		{fieldMapping{Type: "map", Delimiter: "|", Separator: ":", Values: &fieldMapping{Type: "string"}}, "k:v:w", map[string]interface{}{"k": "v:w"}},
+	}
+	for _, tt := range tests {
+		f := tt.field
+		f.Name = "f"
+		if err := f.compile(time.UTC); err != nil {
+			t.Errorf("compile %v: %v", tt.field.Type, err)
+			continue
+		}
+		got, err := f.convert(tt.in)
+		if err != nil {
+			t.Errorf("%v from %q: %v", tt.field.Type, tt.in, err)
+			continue
+		}
+		if r, ok := got.(*big.Rat); ok {
+			if r.Cmp(tt.want.(*big.Rat)) != 0 {
+				t.Errorf("%v from %q = %v, want %v", tt.field.Type, tt.in, r, tt.want)
+			}
+			continue
+		}
+		if tm, ok := got.(time.Time); ok {
+			if !tm.Equal(tt.want.(time.Time)) {
+				t.Errorf("%v from %q = %v, want %v", tt.field.Type, tt.in, tm, tt.want)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v from %q = %#v, want %#v", tt.field.Type, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFieldConvertErrors(t *testing.T) {
+	tests := []struct {
+		field fieldMapping
+		in    string
+	}{
+		{fieldMapping{Type: "long"}, "12a"},
+		{fieldMapping{Type: "int"}, "3000000000"},
+		{fieldMapping{Type: "double"}, "x"},
+		{fieldMapping{Type: "boolean"}, "maybe"},
+		{fieldMapping{Type: typeTimestampMillis, Layouts: []string{"2006-01-02"}}, "07/06/2018"},
+		{fieldMapping{Type: typeDecimal, Precision: 5, Scale: 2}, "1.234"},
+		{fieldMapping{Type: typeDecimal, Precision: 3, Scale: 1}, "100"},
+		{fieldMapping{Type: typeDecimal, Precision: 3, Scale: 1}, "abc"},
+		{fieldMapping{Type: "bytes", Encoding: encodingHex}, "0g"},
+		{fieldMapping{Type: "bytes", Encoding: encodingIP}, "300.0.0.1"},
+		{fieldMapping{Type: "fixed", Size: 4, Encoding: encodingIP}, "::1"},
+		{fieldMapping{Type: "fixed", Size: 3}, "ab"},
+		{fieldMapping{Type: "enum", Symbols: []string{"IN", "OUT"}}, "UP"},
+		{fieldMapping{Type: "array", Items: &fieldMapping{Type: "long"}}, "1|x"},
+		{fieldMapping{Type: "map", Values: &fieldMapping{Type: "string"}}, "a=1;b"},
+	}
+	for _, tt := range tests {
+		f := tt.field
+		f.Name = "f"
+		if err := f.compile(time.UTC); err != nil {
+			t.Errorf("compile %v: %v", tt.field.Type, err)
+			continue
+		}
+		if v, err := f.convert(tt.in); err == nil {
+			t.Errorf("%v from %q = %#v, want an error", tt.field.Type, tt.in, v)
+		}
+	}
+}
+
+func TestFieldCompileErrors(t *testing.T) {
+	tests := []fieldMapping{
+		{Type: "uuid"},
+		{Type: "long", TimeZone: "Nowhere/Special"},
+		{Type: typeDecimal, Precision: 0},
+		{Type: typeDecimal, Precision: 2, Scale: 3},
+		{Type: "bytes", Encoding: "rot13"},
+		{Type: "fixed"},
+		{Type: "fixed", Size: 8, Encoding: encodingIP},
+		{Type: "enum"},
+		{Type: "enum", Symbols: []string{"not valid"}},
+		{Type: "enum", TypeName: "1st", Symbols: []string{"A"}},
+		{Type: "array"},
+		{Type: "map", Values: &fieldMapping{Type: "record", Fields: []fieldMapping{{Name: "x", Type: "long"}}}},
+		{Type: "record"},
+	}
+	for _, f := range tests {
+		f.Name = "f"
+		if err := f.compile(time.UTC); err == nil {
+			t.Errorf("compile %+v succeeded, want an error", f)
+		}
+	}
+}
+
+// TestMappedRecordEncodes checks that the datum of a mapped record matches
+// its schema, nulls and nested records included.
+func TestMappedRecordEncodes(t *testing.T) {
+	one := 1
+	record, err := newMappedRecord("row", []fieldMapping{
+		{Name: "id", Type: "long", Required: true},
+		{Name: "at", Type: typeTimestampMillis, Layouts: []string{defaultTimeLayout}},
+		{Name: "day", Type: typeDate, Layouts: []string{defaultTimeLayout}, Column: &one},
+		{Name: "amount", Type: typeDecimal, Precision: 6, Scale: 2},
+		{Name: "ip", Type: "fixed", Size: 4, Encoding: encodingIP},
+		{Name: "dir", Type: "enum", Symbols: []string{"IN", "OUT"}},
+		{Name: "tags", Type: "array", Items: &fieldMapping{Type: "string"}},
+		{Name: "counts", Type: "map", Values: &fieldMapping{Type: "int"}},
+		{Name: "cell", Type: "record", Fields: []fieldMapping{
+			{Name: "lac", Type: "int"},
+			{Name: "ci", Type: "int"},
+		}},
+	}, "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := NewAvroCodec(record.getSchema())
+	if err != nil {
+		t.Fatalf("schema %v: %v", record.getSchema(), err)
+	}
+	rows := [][]string{
+		{"1", "07/06/2018 18:40:00", "12.5", "10.0.0.1", "IN", "a|b", "x=1", "100", "200"},
+		// Empty and unparsable optional values are null, as is a
+		// record whose columns are all empty.
+		{"2", "", "", "bad", "", "", "", "", ""},
+	}
+	for _, row := range rows {
+		r := record.clone()
+		r.unmarshalFromCSV(row)
+		if _, err := codec.BinaryFromNative(r.toStringMap()); err != nil {
+			t.Errorf("row %q: %v", row, err)
+		}
+	}
+
+	// A missing required value is left out for the encoder to reject.
+	r := record.clone()
+	r.unmarshalFromCSV([]string{"x"})
+	if _, err := codec.BinaryFromNative(r.toStringMap()); err == nil {
+		t.Error("row without its required id encoded, want an error")
+	}
+}
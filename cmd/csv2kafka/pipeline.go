@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"log"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// job is a record of an input file on its way through the pipeline: read
+// by the file's reader, converted by one of the encoding workers and
+// published by the producer. A job without a row marks the end of the file.
+type job struct {
+	file *inputFile
+	line int
+	row  []string
+	rt   *recordType
+	// details is the number of detail rows of the file up to this one.
+	details int
+
+	// Set by the encoding worker before closing done. A job that is not
+	// rejected and has no binary is not published.
+	binary   []byte
+	rejected bool
+	done     chan struct{}
+
+	// delivered receives the delivery report of a record produced
+	// asynchronously, and err the error producing it if any.
+	delivered chan kafka.Event
+	err       error
+
+	eof     bool
+	readErr error
+}
+
+func newJob(f *inputFile, row []string) *job {
+	return &job{file: f, line: f.line, row: row, done: make(chan struct{})}
+}
+
+// maxInFlight bounds the number of records produced but not yet
+// acknowledged.
+const maxInFlight = 10000
+
+// run reads the source's files and publishes their records until the
+// context is done.
+//
+// Up to parallelFiles files are read at a time, each by its own goroutine,
+// and their records converted by a pool of encodeWorkers goroutines. The
+// converted records of each file are handed to the single producer in the
+// order they were read. The producer sends them without waiting for their
+// delivery, which the acknowledger then waits for in the same order, to
+// acknowledge each file's records in order and post-process the file after
+// its last record. In transactional mode a commit covers all the records
+// produced, so the producer acknowledges each record itself once delivered.
+//
+// Once the context is done no more files are opened, and run returns when
+// the files being read have been finished, or stopped at a checkpoint. If a
+// transaction fails, run calls stop to stop all sources, and returns the
+// error once its files are stopped.
+func (s *source) run(ctx context.Context, stop context.CancelFunc) error {
+	encode := make(chan *job, s.encodeWorkers)
+	publish := make(chan *job, s.encodeWorkers)
+	files := make(chan struct{}, s.parallelFiles)
+
+	for i := 0; i < s.encodeWorkers; i++ {
+		go func() {
+			for j := range encode {
+				s.encode(j)
+				close(j.done)
+			}
+		}()
+	}
+	published := make(chan struct{})
+	acks := make(chan *job, maxInFlight)
+	go func() {
+		defer close(published)
+		for j := range acks {
+			s.ack(j, files)
+		}
+	}()
+	go func() {
+		defer close(acks)
+		for j := range publish {
+			s.publish(j)
+			if s.writer.transactional {
+				s.ack(j, files)
+				if s.writer.failed != nil && ctx.Err() == nil {
+					log.Printf("Source %v: stopping after a failed transaction", s.name)
+					stop()
+				}
+				continue
+			}
+			acks <- j
+		}
+	}()
+
+	for ctx.Err() == nil {
+		select {
+		case files <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		f, err := s.reader.Next(ctx)
+		if err != nil {
+			<-files
+			continue
+		}
+		go s.readFile(ctx, f, encode, publish)
+	}
+
+	// Wait for the files being read to be finished.
+	for i := 0; i < cap(files); i++ {
+		files <- struct{}{}
+	}
+	close(encode)
+	close(publish)
+	<-published
+	return s.writer.failed
+}
+
+// readFile reads the records of a file, sending them to be encoded, and
+// passes them on to be published in order once they are. If the context is
+// done and the source is checkpointed, reading stops to be resumed from the
+// last acknowledged record; otherwise the file is read to the end.
+func (s *source) readFile(ctx context.Context, f *inputFile, encode, publish chan<- *job) {
+	pending := make(chan *job, cap(encode)+1)
+	go func() {
+		for j := range pending {
+			<-j.done
+			publish <- j
+		}
+	}()
+	defer close(pending)
+
+	router := s.router.forFile(f.name, f.details)
+	for {
+		if s.resumable && ctx.Err() != nil {
+			s.reader.Drain(f)
+			j := &job{file: f, eof: true, readErr: errStopped, done: make(chan struct{})}
+			close(j.done)
+			pending <- j
+			return
+		}
+		row, err := f.read()
+		if _, ok := err.(*csv.ParseError); ok {
+			log.Printf("Skipping malformed record in file %v: %v", f.name, err)
+			j := newJob(f, nil)
+			j.rejected = true
+			j.details = router.details
+			close(j.done)
+			pending <- j
+			continue
+		}
+		if row == nil {
+			s.reader.Drain(f)
+			if terr := router.endFile(); terr != nil && (err == nil || err == io.EOF) {
+				err = terr
+			}
+			j := &job{file: f, eof: true, readErr: err, done: make(chan struct{})}
+			close(j.done)
+			pending <- j
+			return
+		}
+		j := newJob(f, row)
+		j.rt, err = router.route(row, f.name)
+		if err != nil {
+			log.Println("Skipping record due to error", err)
+			j.rejected = true
+		}
+		j.details = router.details
+		if j.rt == nil {
+			close(j.done)
+			pending <- j
+			continue
+		}
+		pending <- j
+		encode <- j
+	}
+}
+
+func (s *source) encode(j *job) {
+	binary, err := j.rt.encode(j.row, j.file.name)
+	if err != nil {
+		log.Println("Skipping record due to error", err)
+		j.rejected = true
+		return
+	}
+	j.binary = binary
+}
+
+// publish produces a record, waiting for its delivery in transactional
+// mode.
+func (s *source) publish(j *job) {
+	if j.eof || j.rejected || j.binary == nil {
+		return
+	}
+	if !s.writer.transactional {
+		j.delivered = make(chan kafka.Event, 1)
+		if j.err = s.writer.WriteAsync(j.rt.topic, j.binary, j.delivered); j.err != nil {
+			j.delivered = nil
+		}
+		return
+	}
+
+	// rt.codec.TextualFromBinary(binary)
+	_, err := s.writer.WriteTo(j.rt.topic, j.binary)
+	if err != nil && s.writer.failed == nil {
+		log.Println("Error when writing to Kafka", err)
+		// Start over from the last committed checkpoint rather than
+		// lose the rows of the aborted transaction.
+		s.writer.fail(err)
+	}
+}
+
+// ack acknowledges a record once delivered, or finishes its file at its
+// end. After a record of a file fails to be delivered, none of the file's
+// later records are acknowledged, and the file is left to be read again
+// from the last acknowledged one. After a failed transaction nothing more
+// is acknowledged, and files are stopped at their last checkpoint.
+func (s *source) ack(j *job, files <-chan struct{}) {
+	if j.eof {
+		err := j.readErr
+		if j.file.publishErr != nil {
+			err = errPublishFailed
+		}
+		if s.writer.failed != nil {
+			err = errStopped
+		}
+		s.reader.Finish(j.file, err)
+		<-files
+		return
+	}
+	if j.file.publishErr != nil || s.writer.failed != nil {
+		return
+	}
+	j.file.details = j.details
+	if j.rejected {
+		s.reader.Reject(j.file, j.line)
+		return
+	}
+	err := j.err
+	if j.delivered != nil {
+		m := (<-j.delivered).(*kafka.Message)
+		err = m.TopicPartition.Error
+	}
+	if err != nil {
+		log.Println("Error when writing to Kafka", err)
+		j.file.publishErr = err
+		return
+	}
+	s.reader.Ack(j.file, j.line)
+}
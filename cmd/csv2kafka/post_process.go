@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Actions taken on files once their records have been published.
+const (
+	postProcessMove    = "move"
+	postProcessDelete  = "delete"
+	postProcessRename  = "rename"
+	postProcessArchive = "archive"
+	postProcessLeave   = "leave"
+)
+
+// postProcessing is what is done with the files that have been read.
+type postProcessing struct {
+	action string
+	// suffix is appended to the names of renamed files, and archiveDir
+	// is the local dir files are archived to.
+	suffix     string
+	archiveDir string
+}
+
+func newPostProcessing(cfg *sourceConfig, checkpoints checkpointStore) (postProcessing, error) {
+	p := postProcessing{action: cfg.PostProcess, suffix: cfg.PostProcessSuffix, archiveDir: cfg.ArchiveDir}
+	switch p.action {
+	case "", postProcessMove, postProcessDelete:
+	case postProcessRename:
+		if p.suffix == "" {
+			return p, fmt.Errorf("post_process rename requires post_process_suffix")
+		}
+		// A renamed file must not pass for the marker of another, or it
+		// would be removed along with that file's markers.
+		for _, marker := range cfg.DoneMarkers {
+			if strings.HasSuffix(marker, p.suffix) || strings.HasSuffix(p.suffix, marker) {
+				return p, fmt.Errorf("post_process_suffix %q overlaps done marker %q", p.suffix, marker)
+			}
+		}
+	case postProcessArchive:
+		if p.archiveDir == "" {
+			return p, fmt.Errorf("post_process archive requires archive_dir")
+		}
+	case postProcessLeave:
+		if checkpoints == nil {
+			return p, fmt.Errorf("post_process leave requires checkpoint_store")
+		}
+	default:
+		return p, fmt.Errorf("unknown post_process %q", p.action)
+	}
+	return p, nil
+}
+
+// postProcess moves, deletes, renames or archives a file that has been
+// read, or marks it as done and leaves it in place.
+func (r *dirReader) postProcess(current *inputFile) error {
+	name := current.name
+	var err error
+	switch r.post.action {
+	case postProcessDelete:
+		err = r.remove(name)
+	case postProcessRename:
+		err = r.rename(name, name+r.post.suffix)
+	case postProcessArchive:
+		err = r.archive(name)
+	case postProcessLeave:
+		err = r.markDone(current)
+	default:
+		err = r.move(name, r.readyDir)
+	}
+	if err == nil {
+		log.Println("Processed", name)
+	}
+	return err
+}
+
+// remove deletes a file of the input dir.
+func (r *dirReader) remove(name string) error {
+	path := filepath.Join(r.inputDir, name)
+	if err := r.fs.Remove(path); err != nil {
+		log.Printf("Failed to remove %v: %v", path, err)
+		return err
+	}
+	r.removeMarkers(name)
+	if r.cleanupDirs {
+		r.removeEmptyDirs(filepath.Dir(name))
+	}
+	return nil
+}
+
+// rename renames a file in place. Scans skip the renamed file by its
+// suffix. The markers are removed first, so that none of them can be
+// mistaken for the renamed file.
+func (r *dirReader) rename(name, newName string) error {
+	from := filepath.Join(r.inputDir, name)
+	to := filepath.Join(r.inputDir, newName)
+	r.removeMarkers(name)
+	if err := r.fs.Rename(from, to); err != nil {
+		log.Printf("Failed to rename %v to %v: %v", from, to, err)
+		return err
+	}
+	return nil
+}
+
+// archive copies a file of the input dir to the same relative path under
+// the local archive dir, and then deletes it.
+func (r *dirReader) archive(name string) error {
+	from := filepath.Join(r.inputDir, name)
+	to := filepath.Join(r.post.archiveDir, name)
+	if err := copyToLocal(r.fs, from, to); err != nil {
+		log.Printf("Failed to archive %v to %v: %v", from, to, err)
+		return err
+	}
+	return r.remove(name)
+}
+
+// copyToLocal copies a file of fs to a local path, through a temporary file
+// so that the copy is either complete or missing.
+func copyToLocal(fs fileSystem, from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	src, err := fs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := to + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, to)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// markDone checkpoints a file left in place as done, so that it is not read
+// again while its size and modification time are unchanged.
+func (r *dirReader) markDone(current *inputFile) error {
+	cp := &checkpoint{fileIdentity: current.id, Line: current.acked, Rejected: current.rejected, Done: true}
+	if err := r.checkpoints.Save(cp); err != nil {
+		log.Printf("Failed to mark %v as done: %v", current.name, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/sdx13/csv2kafka/internal/pii"
+)
+
+// Protection policies for sensitive fields.
+const (
+	policyDrop    = "drop"    // remove the field from the record
+	policyRedact  = "redact"  // replace the value with a fixed string
+	policyHMAC    = "hmac"    // replace the value with a keyed token
+	policyMask    = "mask"    // mask all but the last characters
+	policyEncrypt = "encrypt" // AES-GCM encrypt with a key file
+)
+
+// protectedField describes how a sensitive field is protected before the
+// record is encoded. Except for drop, the field becomes a nullable string in
+// the schema.
+type protectedField struct {
+	Field       string `yaml:"field"`
+	Policy      string `yaml:"policy"`
+	KeyFile     string `yaml:"key_file,omitempty"`
+	KeepLast    int    `yaml:"keep_last,omitempty"`
+	MaskChar    string `yaml:"mask_char,omitempty"`
+	Replacement string `yaml:"replacement,omitempty"`
+
+	key []byte
+}
+
+func loadProtectedFields(fields []protectedField) error {
+	for i := range fields {
+		f := &fields[i]
+		switch f.Policy {
+		case policyDrop, policyMask:
+		case policyRedact:
+			if f.Replacement == "" {
+				f.Replacement = "REDACTED"
+			}
+		case policyHMAC, policyEncrypt:
+			if f.KeyFile == "" {
+				return fmt.Errorf("protected field %v: %v requires key_file", f.Field, f.Policy)
+			}
+			var err error
+			f.key, err = pii.LoadKey(f.KeyFile)
+			if err != nil {
+				return fmt.Errorf("protected field %v: %v", f.Field, err)
+			}
+			if f.Policy == policyEncrypt {
+				if _, err := pii.Encrypt(f.key, nil); err != nil {
+					return fmt.Errorf("protected field %v: %v", f.Field, err)
+				}
+			}
+		default:
+			return fmt.Errorf("protected field %v: unknown policy %q", f.Field, f.Policy)
+		}
+		if f.Policy == policyMask && len([]rune(f.MaskChar)) > 1 {
+			return fmt.Errorf("protected field %v: mask_char must be a single character", f.Field)
+		}
+	}
+	return nil
+}
+
+// protectFields applies the protection policies to datum in place.
+func protectFields(fields []protectedField, datum map[string]interface{}) error {
+	for _, f := range fields {
+		v, ok := datum[f.Field]
+		if !ok {
+			continue
+		}
+		if f.Policy == policyDrop {
+			delete(datum, f.Field)
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		text := nativeText(v)
+		var protected string
+		switch f.Policy {
+		case policyRedact:
+			protected = f.Replacement
+		case policyHMAC:
+			protected = pii.Token(f.key, text)
+		case policyMask:
+			maskChar := '*'
+			if f.MaskChar != "" {
+				maskChar = []rune(f.MaskChar)[0]
+			}
+			protected = pii.Mask(text, f.KeepLast, maskChar)
+		case policyEncrypt:
+			var err error
+			protected, err = pii.Encrypt(f.key, []byte(text))
+			if err != nil {
+				return fmt.Errorf("protected field %v: %v", f.Field, err)
+			}
+		}
+		datum[f.Field] = goavro.Union("string", protected)
+	}
+	return nil
+}
+
+// nativeText returns the textual form of a goavro native value, unwrapping
+// unions.
+func nativeText(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		for _, inner := range m {
+			return nativeText(inner)
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	}
+	return fmt.Sprint(v)
+}
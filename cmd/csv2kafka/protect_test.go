@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/sdx13/csv2kafka/internal/pii"
+)
+
+func TestProtectFields(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := pii.LoadKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := goavro.Union("long", int64(2222200315))
+
+	tests := []struct {
+		name  string
+		field protectedField
+		value interface{}
+		want  interface{}
+		// decrypt is set for encrypted values, which differ each time.
+		decrypt bool
+	}{
+		{"drop", protectedField{Policy: policyDrop}, phone, nil, false},
+		{"redact", protectedField{Policy: policyRedact}, phone, goavro.Union("string", "REDACTED"), false},
+		{"redact with replacement", protectedField{Policy: policyRedact, Replacement: "xxx"}, "a", goavro.Union("string", "xxx"), false},
+		{"hmac", protectedField{Policy: policyHMAC, KeyFile: keyFile}, phone, goavro.Union("string", pii.Token(key, "2222200315")), false},
+		{"mask", protectedField{Policy: policyMask, KeepLast: 4}, phone, goavro.Union("string", "******0315"), false},
+		{"mask char", protectedField{Policy: policyMask, KeepLast: 2, MaskChar: "#"}, "abcd", goavro.Union("string", "##cd"), false},
+		{"mask string union", protectedField{Policy: policyMask}, goavro.Union("string", "ab"), goavro.Union("string", "**"), false},
+		{"mask bytes", protectedField{Policy: policyMask, KeepLast: 1}, []byte("ab"), goavro.Union("string", "*b"), false},
+		{"mask double", protectedField{Policy: policyMask, KeepLast: 1}, 1.5, goavro.Union("string", "*.5"), false},
+		{"null", protectedField{Policy: policyMask}, nil, nil, false},
+		{"encrypt", protectedField{Policy: policyEncrypt, KeyFile: keyFile}, phone, "2222200315", true},
+	}
+	for _, tt := range tests {
+		fields := []protectedField{tt.field}
+		fields[0].Field = "f"
+		if err := loadProtectedFields(fields); err != nil {
+			t.Errorf("%v: loadProtectedFields: %v", tt.name, err)
+			continue
+		}
+		datum := map[string]interface{}{"f": tt.value, "other": "kept"}
+		if err := protectFields(fields, datum); err != nil {
+			t.Errorf("%v: protectFields: %v", tt.name, err)
+			continue
+		}
+		if datum["other"] != "kept" {
+			t.Errorf("%v: other field changed to %v", tt.name, datum["other"])
+		}
+		got, ok := datum["f"]
+		if tt.field.Policy == policyDrop {
+			if ok {
+				t.Errorf("%v: field still present as %v", tt.name, got)
+			}
+			continue
+		}
+		if tt.decrypt {
+			ciphertext := got.(map[string]interface{})["string"].(string)
+			plaintext, err := pii.Decrypt(key, ciphertext)
+			if err != nil || string(plaintext) != tt.want {
+				t.Errorf("%v: decrypted %q, %v, want %q", tt.name, plaintext, err, tt.want)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+
+	// Fields missing from the record are left out.
+	datum := map[string]interface{}{}
+	fields := []protectedField{{Field: "f", Policy: policyRedact, Replacement: "x"}}
+	if err := protectFields(fields, datum); err != nil || len(datum) != 0 {
+		t.Errorf("protecting a missing field gave %v, %v, want nothing", datum, err)
+	}
+}
+
+func TestLoadProtectedFieldsErrors(t *testing.T) {
+	shortKey := filepath.Join(t.TempDir(), "short")
+	if err := ioutil.WriteFile(shortKey, []byte("0102"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []protectedField{
+		{Field: "f", Policy: "scramble"},
+		{Field: "f"},
+		{Field: "f", Policy: policyHMAC},
+		{Field: "f", Policy: policyEncrypt},
+		{Field: "f", Policy: policyHMAC, KeyFile: "/nonexistent/key"},
+		{Field: "f", Policy: policyEncrypt, KeyFile: shortKey},
+		{Field: "f", Policy: policyMask, MaskChar: "**"},
+	}
+	for _, f := range tests {
+		if err := loadProtectedFields([]protectedField{f}); err == nil {
+			t.Errorf("loadProtectedFields(%+v) succeeded, want an error", f)
+		}
+	}
+}
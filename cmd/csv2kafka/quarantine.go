@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// fileError explains why a file was moved to the error dir. It is written
+// next to the file as <name>.error.json.
+type fileError struct {
+	File         string    `json:"file"`
+	Reason       string    `json:"reason"`
+	Error        string    `json:"error,omitempty"`
+	Attempts     int       `json:"attempts,omitempty"`
+	Rows         int       `json:"rows,omitempty"`
+	RejectedRows int       `json:"rejected_rows,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// fail records a failed attempt at reading a file, moving the file to the
+// error dir once it has failed maxAttempts times in a row, or at once if its
+// trailer does not match it.
+func (r *dirReader) fail(name, reason string, err error) {
+	if r.errorDir == "" {
+		return
+	}
+	r.mu.Lock()
+	if r.failures == nil {
+		r.failures = make(map[string]int)
+	}
+	r.failures[name]++
+	attempts := r.failures[name]
+	_, permanent := err.(*trailerError)
+	if attempts < r.maxAttempts && !permanent {
+		r.mu.Unlock()
+		log.Printf("File %v failed %d of %d attempts", name, attempts, r.maxAttempts)
+		return
+	}
+	delete(r.failures, name)
+	delete(r.retries, name)
+	r.mu.Unlock()
+	qerr := r.quarantine(name, &fileError{
+		Reason:   reason,
+		Error:    err.Error(),
+		Attempts: attempts,
+	})
+	if qerr == nil && r.checkpoints != nil {
+		if err := r.checkpoints.Delete(r.key(name)); err != nil {
+			log.Printf("Failed to delete checkpoint for %v: %v", name, err)
+		}
+	}
+}
+
+func (r *dirReader) tooManyRejected(current *inputFile) bool {
+	if r.errorDir == "" || r.maxRejectedRatio <= 0 || current.line == 0 {
+		return false
+	}
+	return float64(current.rejected)/float64(current.line) > r.maxRejectedRatio
+}
+
+// quarantine moves a file to the error dir and writes the explanation of
+// why next to it.
+func (r *dirReader) quarantine(name string, fe *fileError) error {
+	from := filepath.Join(r.inputDir, name)
+	to := filepath.Join(r.errorDir, name)
+	fe.File = name
+	fe.Time = time.Now()
+	if err := r.move(name, r.errorDir); err != nil {
+		return err
+	}
+	log.Printf("Moved %v to %v: %v", from, to, fe.Reason)
+
+	content, err := json.MarshalIndent(fe, "", "  ")
+	if err != nil {
+		return err
+	}
+	sidecar := to + ".error.json"
+	f, err := r.fs.Create(sidecar)
+	if err != nil {
+		log.Printf("Failed to create %v: %v", sidecar, err)
+		return nil
+	}
+	_, err = f.Write(append(content, '\n'))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		log.Printf("Failed to write %v: %v", sidecar, err)
+	}
+	return nil
+}
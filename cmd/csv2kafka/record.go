@@ -4,4 +4,7 @@ type Record interface {
 	unmarshalFromCSV(record []string)
 	toStringMap() map[string]interface{}
 	getSchema() string
+	// clone returns an empty record of the same kind, so that rows can be
+	// converted concurrently.
+	clone() Record
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"net"
 	"strconv"
 	"time"
 
@@ -15,6 +14,10 @@ type hitsRecord struct {
 	mobile    string
 }
 
+func (r *hitsRecord) clone() Record {
+	return &hitsRecord{}
+}
+
 func (r *hitsRecord) getSchema() string {
 	return `{
         "type" : "record",
@@ -74,15 +77,6 @@ func (r *hitsRecord) toStringMap() map[string]interface{} {
 	return datum
 }
 
-func getIP(s string) interface{} {
-	ip := net.ParseIP(s)
-	if ip == nil {
-		log.Printf("Error parsing IP %v\n", s)
-		ip = []byte{0x00, 0x00, 0x00, 0x00}
-	}
-	return []byte(ip)
-}
-
 func getTime(s string) interface{} {
 	t, err := time.Parse("01/02/2006 15:04:05", s)
 	if err != nil {
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sdx13/csv2kafka/internal/expr"
+)
+
+// Roles of record types in files mixing several of them. Only detail rows
+// are counted against the trailer.
+const (
+	roleHeader  = "header"
+	roleDetail  = "detail"
+	roleTrailer = "trailer"
+)
+
+// recordTypeConfig describes one kind of row in files that interleave
+// several record types. A row belongs to the first type whose Value equals,
+// or whose Pattern matches, the row's discriminator Column. Rows of a type
+// without a mapping are recognised but not published.
+type recordTypeConfig struct {
+	Name        string `yaml:"name"`
+	Column      int    `yaml:"column,omitempty"`
+	Value       string `yaml:"value,omitempty"`
+	Pattern     string `yaml:"pattern,omitempty"`
+	Role        string `yaml:"role,omitempty"`
+	CountColumn int    `yaml:"count_column,omitempty"`
+
+	KafkaTopic     string           `yaml:"kafka_topic,omitempty"`
+	RecordName     string           `yaml:"record_name,omitempty"`
+	Mapping        []fieldMapping   `yaml:"mapping,omitempty"`
+	Filter         string           `yaml:"filter,omitempty"`
+	ComputedFields []computedField  `yaml:"computed_fields,omitempty"`
+	ProtectFields  []protectedField `yaml:"protect_fields,omitempty"`
+}
+
+// recordType converts rows of one kind into Avro messages for a topic.
+type recordType struct {
+	name     string
+	topic    string
+	record   Record
+	codec    *AvroCodec
+	filter   *expr.Expr
+	computed []computedField
+	protect  []protectedField
+}
+
+func newRecordType(name, topic string, record Record, filter string, computed []computedField, protect []protectedField) (*recordType, error) {
+	t := &recordType{
+		name:     name,
+		topic:    topic,
+		record:   record,
+		computed: computed,
+		protect:  protect,
+	}
+	var err error
+	if filter != "" {
+		t.filter, err = expr.Parse(filter)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %v", filter, err)
+		}
+	}
+	if err := compileComputedFields(computed); err != nil {
+		return nil, err
+	}
+	if err := loadProtectedFields(protect); err != nil {
+		return nil, err
+	}
+	schema, err := extendSchema(record.getSchema(), computed)
+	if err != nil {
+		return nil, fmt.Errorf("adding computed fields to schema: %v", err)
+	}
+	schema, err = protectSchema(schema, protect)
+	if err != nil {
+		return nil, fmt.Errorf("applying field protection to schema: %v", err)
+	}
+	t.codec, err = NewAvroCodec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema: %v", err)
+	}
+	return t, nil
+}
+
+// encode converts a row read from fileName into its Avro binary form. It
+// returns nil without an error if the row is dropped by the filter. It may
+// be called concurrently.
+func (t *recordType) encode(row []string, fileName string) ([]byte, error) {
+	record := t.record.clone()
+	record.unmarshalFromCSV(row)
+	datum := record.toStringMap()
+	err := computeFields(t.computed, datum, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if t.filter != nil {
+		keep, err := t.filter.Match(datum)
+		if err != nil {
+			return nil, fmt.Errorf("filter: %v", err)
+		}
+		if !keep {
+			return nil, nil
+		}
+	}
+	err = protectFields(t.protect, datum)
+	if err != nil {
+		return nil, err
+	}
+	binary, err := t.codec.BinaryFromNative(datum)
+	if err != nil {
+		// XXX/PDP Audit this error message. It usually
+		// denotes receiving a record that does not have a
+		// mandatory field.
+		return nil, fmt.Errorf("could not convert to binary: %v", err)
+	}
+	return binary, nil
+}
+
+type routedType struct {
+	recordTypeConfig
+	re *regexp.Regexp
+	// t is nil for types that are not published.
+	t *recordType
+}
+
+func (r *routedType) matches(row []string) bool {
+	if r.Column >= len(row) {
+		return false
+	}
+	v := row[r.Column]
+	if r.re != nil {
+		return r.re.MatchString(v)
+	}
+	return v == r.Value
+}
+
+// recordRouter picks the record type of each row and checks the detail row
+// count announced by trailer rows against the number of detail rows read
+// from the file.
+type recordRouter struct {
+	types []*routedType
+	// single is used for all rows when no record types are configured.
+	single *recordType
+
+	hasTrailer  bool
+	file        string
+	details     int
+	trailerSeen bool
+	trailerErr  error
+}
+
+// trailerError is a trailer row that does not match the detail rows of its
+// file. Reading the file again does not help.
+type trailerError struct {
+	err error
+}
+
+func (e *trailerError) Error() string {
+	return e.err.Error()
+}
+
+func newRecordRouter(cfg *sourceConfig) (*recordRouter, error) {
+	if len(cfg.RecordTypes) == 0 {
+		record, err := recordFactory(cfg)
+		if err != nil {
+			return nil, err
+		}
+		t, err := newRecordType(cfg.RecordName, cfg.KafkaTopic, record, cfg.Filter, cfg.ComputedFields, cfg.ProtectFields)
+		if err != nil {
+			return nil, err
+		}
+		return &recordRouter{single: t}, nil
+	}
+
+	r := &recordRouter{}
+	for i, c := range cfg.RecordTypes {
+		rt := &routedType{recordTypeConfig: c}
+		if rt.Name == "" {
+			rt.Name = strconv.Itoa(i)
+		}
+		switch rt.Role {
+		case "":
+			rt.Role = roleDetail
+		case roleHeader, roleDetail:
+		case roleTrailer:
+			r.hasTrailer = true
+		default:
+			return nil, fmt.Errorf("record type %v: unknown role %q", rt.Name, rt.Role)
+		}
+		if rt.Pattern != "" {
+			var err error
+			rt.re, err = regexp.Compile(rt.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("record type %v: %v", rt.Name, err)
+			}
+		}
+		if len(rt.Mapping) > 0 {
+			recordName := rt.RecordName
+			if recordName == "" {
+				recordName = rt.Name
+			}
+			record, err := newMappedRecord(recordName, rt.Mapping, cfg.TimeZone)
+			if err != nil {
+				return nil, fmt.Errorf("record type %v: %v", rt.Name, err)
+			}
+			topic := rt.KafkaTopic
+			if topic == "" {
+				topic = cfg.KafkaTopic
+			}
+			rt.t, err = newRecordType(rt.Name, topic, record, rt.Filter, rt.ComputedFields, rt.ProtectFields)
+			if err != nil {
+				return nil, fmt.Errorf("record type %v: %v", rt.Name, err)
+			}
+		}
+		r.types = append(r.types, rt)
+	}
+	return r, nil
+}
+
+// forFile returns a router for the rows of the named file, so that files
+// read concurrently are counted separately. details is the number of detail
+// rows skipped when resuming the file.
+func (r *recordRouter) forFile(fileName string, details int) *recordRouter {
+	c := *r
+	c.file = fileName
+	c.details = details
+	c.trailerSeen = false
+	c.trailerErr = nil
+	return &c
+}
+
+// route returns the record type to publish a row read from fileName as, or
+// nil if the row is not to be published.
+func (r *recordRouter) route(row []string, fileName string) (*recordType, error) {
+	if r.single != nil {
+		return r.single, nil
+	}
+	if fileName != r.file {
+		r.endFile()
+		r.file = fileName
+	}
+	for _, rt := range r.types {
+		if !rt.matches(row) {
+			continue
+		}
+		switch rt.Role {
+		case roleDetail:
+			r.details++
+		case roleTrailer:
+			r.trailerSeen = true
+			if err := r.checkTrailer(rt, row); err != nil {
+				r.trailerErr = &trailerError{err}
+			}
+		}
+		return rt.t, nil
+	}
+	return nil, fmt.Errorf("row matches no record type: %q", strings.Join(row, ","))
+}
+
+func (r *recordRouter) checkTrailer(rt *routedType, row []string) error {
+	if rt.CountColumn >= len(row) {
+		return fmt.Errorf("trailer has no column %d", rt.CountColumn)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(row[rt.CountColumn]))
+	if err != nil {
+		return fmt.Errorf("invalid detail row count: %v", err)
+	}
+	if count != r.details {
+		return fmt.Errorf("trailer announces %d detail rows, read %d", count, r.details)
+	}
+	log.Printf("Trailer of file %v matches %d detail rows", r.file, r.details)
+	return nil
+}
+
+// endFile warns about a file that ended without the expected trailer,
+// returns the *trailerError of a trailer not matching the file, and resets
+// the per-file counts.
+func (r *recordRouter) endFile() error {
+	if r.file != "" && r.hasTrailer && !r.trailerSeen {
+		log.Printf("File %v has no trailer row; read %d detail rows", r.file, r.details)
+	}
+	err := r.trailerErr
+	r.details = 0
+	r.trailerSeen = false
+	r.trailerErr = nil
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// relFileInfo is an entry of a subdirectory of the input dir, named by its
+// path relative to the input dir.
+type relFileInfo struct {
+	os.FileInfo
+	rel string
+}
+
+func (fi relFileInfo) Name() string {
+	return fi.rel
+}
+
+// scan lists the entries of the input dir and, down to scanDepth levels,
+// of its subdirectories. Entries of subdirectories are named by their path
+// relative to the input dir.
+func (r *dirReader) scan() ([]os.FileInfo, error) {
+	log.Println("Scanning for files in dir", r.inputDir)
+	return r.scanDir("", 0)
+}
+
+func (r *dirReader) scanDir(rel string, depth int) ([]os.FileInfo, error) {
+	dir := filepath.Join(r.inputDir, rel)
+	// Watching before listing, files appearing in between are not
+	// missed.
+	if err := r.watcher.Watch(dir); err != nil {
+		log.Printf("Failed to watch dir %v: %v", dir, err)
+	}
+	entries, err := r.fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var all []os.FileInfo
+	for _, info := range entries {
+		if rel != "" {
+			info = relFileInfo{FileInfo: info, rel: filepath.Join(rel, info.Name())}
+		}
+		all = append(all, info)
+		if !info.IsDir() || depth >= r.scanDepth {
+			continue
+		}
+		if !r.selection.hidden && strings.HasPrefix(filepath.Base(info.Name()), ".") {
+			continue
+		}
+		sub, err := r.scanDir(info.Name(), depth+1)
+		if err != nil {
+			log.Printf("Failed to read dir %v: %v", info.Name(), err)
+			continue
+		}
+		all = append(all, sub...)
+	}
+	return all, nil
+}
+
+// move moves a file of the input dir to the same relative path under dir,
+// creating the directories it needs there.
+func (r *dirReader) move(name, dir string) error {
+	from := filepath.Join(r.inputDir, name)
+	to := filepath.Join(dir, name)
+	if parent := filepath.Dir(name); parent != "." {
+		if err := r.fs.MkdirAll(filepath.Join(dir, parent)); err != nil {
+			log.Printf("Failed to create %v: %v", filepath.Join(dir, parent), err)
+			return err
+		}
+	}
+	if err := r.fs.Rename(from, to); err != nil {
+		log.Printf("Failed to rename %v to %v: %v", from, to, err)
+		return err
+	}
+	r.removeMarkers(name)
+	if r.cleanupDirs {
+		r.removeEmptyDirs(filepath.Dir(name))
+	}
+	return nil
+}
+
+// removeEmptyDirs removes the subdirectory rel of the input dir, and then
+// its parents, as long as they are empty.
+func (r *dirReader) removeEmptyDirs(rel string) {
+	for rel != "." && rel != "" {
+		path := filepath.Join(r.inputDir, rel)
+		entries, err := r.fs.ReadDir(path)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+		if err := r.fs.Remove(path); err != nil {
+			log.Printf("Failed to remove empty dir %v: %v", path, err)
+			return
+		}
+		log.Println("Removed empty dir", path)
+		rel = filepath.Dir(rel)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+func parseRecordSchema(schema string) (map[string]interface{}, []interface{}, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &record); err != nil {
+		return nil, nil, err
+	}
+	fields, _ := record["fields"].([]interface{})
+	return record, fields, nil
+}
+
+func formatRecordSchema(record map[string]interface{}, fields []interface{}) (string, error) {
+	record["fields"] = fields
+	b, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func fieldName(f interface{}) string {
+	if f, ok := f.(map[string]interface{}); ok {
+		if name, ok := f["name"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// extendSchema returns the record schema with a nullable field appended for
+// each computed field.
+func extendSchema(schema string, computed []computedField) (string, error) {
+	if len(computed) == 0 {
+		return schema, nil
+	}
+	record, fields, err := parseRecordSchema(schema)
+	if err != nil {
+		return "", err
+	}
+	names := make(map[string]bool)
+	for _, f := range fields {
+		names[fieldName(f)] = true
+	}
+	for _, c := range computed {
+		if names[c.Name] {
+			return "", fmt.Errorf("computed field %v already exists in schema", c.Name)
+		}
+		names[c.Name] = true
+		fields = append(fields, map[string]interface{}{
+			"name":    c.Name,
+			"type":    []interface{}{"null", c.Type},
+			"default": nil,
+		})
+	}
+	return formatRecordSchema(record, fields)
+}
+
+// protectSchema returns the record schema with dropped fields removed and
+// the other protected fields turned into nullable strings.
+func protectSchema(schema string, protected []protectedField) (string, error) {
+	if len(protected) == 0 {
+		return schema, nil
+	}
+	record, fields, err := parseRecordSchema(schema)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range protected {
+		found := false
+		for i, f := range fields {
+			if fieldName(f) != p.Field {
+				continue
+			}
+			found = true
+			if p.Policy == policyDrop {
+				fields = append(fields[:i], fields[i+1:]...)
+			} else {
+				fields[i] = map[string]interface{}{
+					"name":    p.Field,
+					"type":    []interface{}{"null", "string"},
+					"default": nil,
+				}
+			}
+			break
+		}
+		if !found {
+			return "", fmt.Errorf("protected field %v not in schema", p.Field)
+		}
+	}
+	return formatRecordSchema(record, fields)
+}
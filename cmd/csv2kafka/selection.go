@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Orders in which the files of a scan are read.
+const (
+	orderName     = "name"
+	orderMtime    = "mtime"
+	orderNameTime = "name_time"
+)
+
+// selection decides which entries of the input dir are input files and in
+// which order they are read.
+type selection struct {
+	include []namePattern
+	exclude []namePattern
+	hidden  bool
+	// skipSuffix is the suffix of files renamed once read.
+	skipSuffix string
+
+	order      string
+	timeRe     *regexp.Regexp
+	timeLayout string
+}
+
+// namePattern is a glob pattern, or a regular expression if written with a
+// "regex:" prefix.
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compileNamePatterns(patterns []string) ([]namePattern, error) {
+	var compiled []namePattern
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "regex:") {
+			re, err := regexp.Compile(strings.TrimPrefix(p, "regex:"))
+			if err != nil {
+				return nil, fmt.Errorf("pattern %q: %v", p, err)
+			}
+			compiled = append(compiled, namePattern{re: re})
+			continue
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", p, err)
+		}
+		compiled = append(compiled, namePattern{glob: p})
+	}
+	return compiled, nil
+}
+
+func (p namePattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := filepath.Match(p.glob, name)
+	return ok
+}
+
+func matchAny(patterns []namePattern, name string) bool {
+	for _, p := range patterns {
+		if p.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func newSelection(cfg *sourceConfig) (selection, error) {
+	s := selection{
+		hidden:     cfg.IncludeHidden,
+		order:      cfg.Order,
+		timeLayout: cfg.NameTimeLayout,
+	}
+	if cfg.PostProcess == postProcessRename {
+		s.skipSuffix = cfg.PostProcessSuffix
+	}
+	var err error
+	if s.include, err = compileNamePatterns(cfg.IncludePatterns); err != nil {
+		return s, err
+	}
+	if s.exclude, err = compileNamePatterns(cfg.ExcludePatterns); err != nil {
+		return s, err
+	}
+	switch s.order {
+	case "", orderName, orderMtime:
+	case orderNameTime:
+		s.timeRe, err = regexp.Compile(cfg.NameTimePattern)
+		if err != nil {
+			return s, fmt.Errorf("name_time_pattern: %v", err)
+		}
+		if s.timeRe.NumSubexp() > 1 {
+			return s, fmt.Errorf("name_time_pattern has more than one group")
+		}
+	default:
+		return s, fmt.Errorf("unknown order %q", s.order)
+	}
+	return s, nil
+}
+
+// filter returns the entries that are not directories, not hidden unless
+// hidden files are wanted, match an include pattern if there are any and
+// match no exclude pattern. Files renamed once read are left out too.
+func (s *selection) filter(files []os.FileInfo) []os.FileInfo {
+	var selected []os.FileInfo
+	for _, info := range files {
+		name := filepath.Base(info.Name())
+		switch {
+		case info.IsDir():
+		case !s.hidden && strings.HasPrefix(name, "."):
+		case len(s.include) > 0 && !matchAny(s.include, name):
+		case matchAny(s.exclude, name):
+		case s.skipSuffix != "" && strings.HasSuffix(name, s.skipSuffix):
+		default:
+			selected = append(selected, info)
+		}
+	}
+	return selected
+}
+
+// sort orders files by name, by modification time or by the time in their
+// names. Files whose names hold no time come last, by name.
+func (s *selection) sort(files []os.FileInfo) {
+	switch s.order {
+	case orderMtime:
+		sort.SliceStable(files, func(i, j int) bool {
+			ti, tj := files[i].ModTime(), files[j].ModTime()
+			if ti.Equal(tj) {
+				return files[i].Name() < files[j].Name()
+			}
+			return ti.Before(tj)
+		})
+	case orderNameTime:
+		times := make(map[string]time.Time, len(files))
+		for _, info := range files {
+			if t, ok := s.nameTime(info.Name()); ok {
+				times[info.Name()] = t
+			}
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			ti, iok := times[files[i].Name()]
+			tj, jok := times[files[j].Name()]
+			switch {
+			case iok && jok && !ti.Equal(tj):
+				return ti.Before(tj)
+			case iok != jok:
+				return iok
+			}
+			return files[i].Name() < files[j].Name()
+		})
+	default:
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Name() < files[j].Name()
+		})
+	}
+}
+
+// nameTime parses the time in a file name, matched by the group of the
+// name time pattern or else by the whole pattern.
+func (s *selection) nameTime(name string) (time.Time, bool) {
+	m := s.timeRe.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	v := m[len(m)-1]
+	t, err := time.Parse(s.timeLayout, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
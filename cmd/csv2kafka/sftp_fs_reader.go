@@ -1,57 +1,71 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"math/rand"
+	"net"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+// SftpFilesystemReader reads files from a remote directory over SFTP. It is
+// its own fileSystem, connecting on first use and reconnecting whenever the
+// connection is found to be lost.
 type SftpFilesystemReader struct {
-	inputDir     string
-	readyDir     string
-	waitInterval int
-
-	files          []os.FileInfo
-	reader         *GzipReader
-	index          int
-	privateKeyPath string
-	user           string
-	password       string
-	ip             string
-	port           string
-	ssh            *ssh.Client
-	client         *sftp.Client
-}
-
-func getSSHConfig(privateKeyPath, user, password string, hostKeyCheck bool) *ssh.ClientConfig {
-	var methods []ssh.AuthMethod
-	key, err := ioutil.ReadFile(privateKeyPath)
-	if err == nil {
-		signer, err := ssh.ParsePrivateKey(key)
-		if err == nil {
-			methods = append(methods, ssh.PublicKeys(signer))
-		}
-	}
+	*dirReader
 
-	methods = append(methods, ssh.Password(password))
+	// ctx stops the attempts to reconnect once done.
+	ctx context.Context
 
-	var hostKeyCallback ssh.HostKeyCallback
-	if !hostKeyCheck {
-		hostKeyCallback = ssh.InsecureIgnoreHostKey()
-	} else {
-		hostKeyCallback, err = knownhosts.New(filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
-		if err != nil {
-			hostKeyCallback = ssh.InsecureIgnoreHostKey()
-		}
+	ip   string
+	port string
+	// auth logs in to the server and hostKeyCallback verifies its host
+	// key.
+	auth            *sshAuth
+	hostKeyCallback ssh.HostKeyCallback
+	// jumps are the jump hosts the server is reached through.
+	jumps []sshHop
+
+	keepaliveInterval time.Duration
+	reconnectAttempts int
+
+	// connMu guards the connection, shared by the reading and the
+	// post-processing of files.
+	connMu sync.Mutex
+	conn   *sftpConn
+}
+
+// sftpConn is a connection to the SFTP server, through the connections to
+// the jump hosts in hops if any. lost is closed once the connection is lost.
+type sftpConn struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	hops   []*ssh.Client
+	lost   chan struct{}
+}
+
+// close closes the SSH connection first, as closing the SFTP session waits
+// for the server, which may not answer.
+func (c *sftpConn) close() error {
+	err := c.ssh.Close()
+	if c.client != nil {
+		c.client.Close()
 	}
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		c.hops[i].Close()
+	}
+	return err
+}
 
+func getSSHConfig(user string, methods []ssh.AuthMethod, hostKeyCallback ssh.HostKeyCallback) *ssh.ClientConfig {
 	return &ssh.ClientConfig{
 		User:            user,
 		HostKeyCallback: hostKeyCallback,
@@ -59,120 +73,281 @@ func getSSHConfig(privateKeyPath, user, password string, hostKeyCheck bool) *ssh
 	}
 }
 
-func getSSHClient(config *ssh.ClientConfig, host, port string) (*ssh.Client, error) {
-	return ssh.Dial("tcp", host+":"+port, config)
+// getSSHClient connects to the server at host and port through the jump
+// hosts, in order. It also returns the clients of the jump hosts, to be
+// closed after the server's.
+func getSSHClient(ctx context.Context, config *ssh.ClientConfig, host, port string, jumps []sshHop) (*ssh.Client, []*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+	for _, jump := range jumps {
+		methods, authenticated := jump.auth.authMethods()
+		hopConfig := getSSHConfig(jump.auth.user, methods, jump.hostKeyCallback)
+		hopConfig.Timeout = config.Timeout
+		c, err := dialVia(ctx, hops, jump.addr, hopConfig)
+		authenticated()
+		if err != nil {
+			closeHops()
+			return nil, nil, fmt.Errorf("jump host %v: %v", jump.addr, err)
+		}
+		hops = append(hops, c)
+	}
+	c, err := dialVia(ctx, hops, net.JoinHostPort(host, port), config)
+	if err != nil {
+		closeHops()
+		return nil, nil, err
+	}
+	return c, hops, nil
 }
 
 func getSFTPClient(conn *ssh.Client) (*sftp.Client, error) {
 	return sftp.NewClient(conn)
 }
 
-func (r *SftpFilesystemReader) Read() ([]string, error) {
-	if len(r.files) == 0 {
-		i := 0
-		log.Println("Scanning for files in dir", r.inputDir)
-		files, err := r.readDir(r.inputDir)
-		if err != nil {
-			log.Printf("Failed to read input dir: %v", err)
-			return nil, err
+// Delays between attempts to connect to the SFTP server, which double from
+// reconnectMinDelay up to reconnectMaxDelay, with up to half of it added or
+// taken away at random so that readers do not retry in step.
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// sshDialTimeout bounds the time to connect to each SSH server, jump hosts
+// included, and complete the SSH handshake with it.
+const sshDialTimeout = 30 * time.Second
+
+func (r *SftpFilesystemReader) dial() (*sftpConn, error) {
+	methods, authenticated := r.auth.authMethods()
+	sshConfig := getSSHConfig(r.auth.user, methods, r.hostKeyCallback)
+	sshConfig.Timeout = sshDialTimeout
+	sshClient, hops, err := getSSHClient(r.ctx, sshConfig, r.ip, r.port, r.jumps)
+	authenticated()
+	if err != nil {
+		return nil, err
+	}
+	conn := &sftpConn{ssh: sshClient, hops: hops, lost: make(chan struct{})}
+	conn.client, err = getSFTPClient(sshClient)
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connection returns the connection to the SFTP server, connecting if there
+// is none or it has been lost. Failed attempts to connect are retried with
+// backoff, up to reconnectAttempts in all, unless ctx is done.
+func (r *SftpFilesystemReader) connection() (*sftpConn, error) {
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		conn, err := r.connect(attempt)
+		if err == nil {
+			return conn, nil
 		}
-		for ; i < len(files); i++ {
-			name := filepath.Join(r.inputDir, files[i].Name())
-			log.Println("Reading file", name)
-			f, err := r.client.Open(name)
-			if err != nil {
-				log.Println("Failed to open file", err)
-				continue
-			}
-			reader, err := NewGzipReader(f)
-			if err == nil {
-				r.reader = reader
-				r.index = i
-				r.files = files
-				break
-			} else {
-				log.Printf("Could not open file for reading: %v", err)
-			}
+		if attempt >= r.reconnectAttempts || r.ctx.Err() != nil {
+			return nil, fmt.Errorf("could not connect to SFTP server %v: %v", r.ip, err)
 		}
-		if i == len(files) {
-			log.Println("No input file found")
-			log.Printf("Waiting for %v seconds", r.waitInterval)
-			time.Sleep(time.Duration(r.waitInterval) * time.Second)
-			return r.Read()
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		log.Printf("Failed to connect to SFTP server %v: %v, retrying in %v", r.ip, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return nil, fmt.Errorf("could not connect to SFTP server %v: %v", r.ip, err)
+		}
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
 		}
 	}
-	record, err := r.reader.Read()
-	if record == nil {
-		err := r.close()
-		currentName := r.files[r.index].Name()
-		if err != nil {
-			fmt.Printf("Error closing file %v: %v", currentName, err)
-		} else {
-			log.Println("Closed file", currentName)
+}
+
+// connect returns the current connection if it is not lost, or else makes
+// the given attempt to connect. connMu is held meanwhile, but not between
+// attempts.
+func (r *SftpFilesystemReader) connect(attempt int) (*sftpConn, error) {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	if r.conn != nil {
+		select {
+		case <-r.conn.lost:
+			log.Printf("Connection to SFTP server %v lost", r.ip)
+			r.disconnect()
+		default:
+			return r.conn, nil
 		}
-		r.files = r.files[1:]
-		r.postProcess(currentName)
-		return r.Read()
 	}
-	return record, err
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+	go r.watchConnection(r.conn)
+	if attempt > 1 {
+		log.Printf("Reconnected to SFTP server %v", r.ip)
+	}
+	return r.conn, nil
 }
 
-func (r *SftpFilesystemReader) close() error {
-	// XXX/PDP audit this
-	// return r.reader.Close()
-	return nil
+// watchConnection closes lost once the SSH connection is closed, which it
+// is if a keepalive goes unanswered for keepaliveInterval.
+func (r *SftpFilesystemReader) watchConnection(conn *sftpConn) {
+	c := conn.ssh
+	if r.keepaliveInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(r.keepaliveInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-conn.lost:
+					return
+				case <-ticker.C:
+				}
+				reply := make(chan error, 1)
+				go func() {
+					_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+					reply <- err
+				}()
+				select {
+				case err := <-reply:
+					if err == nil {
+						continue
+					}
+					log.Printf("SFTP keepalive failed: %v", err)
+				case <-time.After(r.keepaliveInterval):
+					log.Printf("No reply to SFTP keepalive within %v", r.keepaliveInterval)
+				}
+				c.Close()
+				return
+			}
+		}()
+	}
+	c.Wait()
+	close(conn.lost)
 }
 
-func (r *SftpFilesystemReader) postProcess(name string) {
-	from := filepath.Join(r.inputDir, name)
-	to := filepath.Join(r.readyDir, name)
-	err := r.client.Rename(from, to)
-	if err != nil {
-		fmt.Printf("Failed to rename %v to %v: %v", from, to, err)
-	} else {
-		log.Println("Processed", name)
-	}
-}
-
-func (r *SftpFilesystemReader) sftpInit() error {
-	// XXX/PDP take this from config
-	hostKeyCheck := false
-	privateKeyPath := r.privateKeyPath
-	user := r.user
-	pass := r.password
-	ip := r.ip
-	port := r.port
-	sshConfig := getSSHConfig(privateKeyPath, user, pass, hostKeyCheck)
-	sshClient, err := getSSHClient(sshConfig, ip, port)
-	if err != nil {
-		return err
+// disconnect closes the connection. connMu must be held.
+func (r *SftpFilesystemReader) disconnect() error {
+	if r.conn == nil {
+		return nil
 	}
-	sftpClient, err := getSFTPClient(sshClient)
-	if err != nil {
-		return err
+	err := r.conn.close()
+	r.conn = nil
+	return err
+}
+
+// broken tells whether err is due to the loss of conn, and if so drops it
+// to be reconnected on next use.
+func (r *SftpFilesystemReader) broken(err error, conn *sftpConn) bool {
+	select {
+	case <-conn.lost:
+	default:
+		if !errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+			return false
+		}
 	}
-	r.ssh = sshClient
-	r.client = sftpClient
-	return nil
+	r.connMu.Lock()
+	if r.conn == conn {
+		log.Printf("Connection to SFTP server %v lost", r.ip)
+		r.disconnect()
+	}
+	r.connMu.Unlock()
+	return true
 }
 
-func (r *SftpFilesystemReader) readDir(path string) ([]os.FileInfo, error) {
-	if r.client == nil {
-		err := r.sftpInit()
+// do runs op with the SFTP client, once more after reconnecting if the
+// connection turns out to be lost.
+func (r *SftpFilesystemReader) do(op func(c *sftp.Client) error) error {
+	for retried := false; ; retried = true {
+		conn, err := r.connection()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		err = op(conn.client)
+		if err == nil || retried || !r.broken(err, conn) {
+			return err
 		}
 	}
-	/*
-		f, err := r.client.Open(path)
+}
+
+func (r *SftpFilesystemReader) ReadDir(path string) ([]os.FileInfo, error) {
+	var filesInfo []os.FileInfo
+	err := r.do(func(c *sftp.Client) error {
+		var err error
+		filesInfo, err = c.ReadDir(path)
+		return err
+	})
+	return filesInfo, err
+}
+
+// Open opens a remote file for reading. If the connection is lost while it
+// is read, reads fail with errConnectionLost.
+func (r *SftpFilesystemReader) Open(path string) (io.ReadCloser, error) {
+	for retried := false; ; retried = true {
+		conn, err := r.connection()
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close()
-	*/
-	filesInfo, err := r.client.ReadDir(path)
-	if err != nil {
-		return nil, err
+		file, err := conn.client.Open(path)
+		if err == nil {
+			return &sftpFile{File: file, r: r, conn: conn}, nil
+		}
+		if retried || !r.broken(err, conn) {
+			return nil, err
+		}
+	}
+}
+
+func (r *SftpFilesystemReader) Rename(from, to string) error {
+	return r.do(func(c *sftp.Client) error {
+		return c.Rename(from, to)
+	})
+}
+
+func (r *SftpFilesystemReader) Create(path string) (io.WriteCloser, error) {
+	var f io.WriteCloser
+	err := r.do(func(c *sftp.Client) error {
+		file, err := c.Create(path)
+		if err != nil {
+			return err
+		}
+		f = file
+		return nil
+	})
+	return f, err
+}
+
+func (r *SftpFilesystemReader) Remove(path string) error {
+	return r.do(func(c *sftp.Client) error {
+		return c.Remove(path)
+	})
+}
+
+func (r *SftpFilesystemReader) MkdirAll(path string) error {
+	return r.do(func(c *sftp.Client) error {
+		return c.MkdirAll(path)
+	})
+}
+
+// Close closes the SFTP session and the SSH connection under it.
+func (r *SftpFilesystemReader) Close() error {
+	r.connMu.Lock()
+	defer r.connMu.Unlock()
+	return r.disconnect()
+}
+
+// sftpFile is a remote file being read.
+type sftpFile struct {
+	*sftp.File
+	r    *SftpFilesystemReader
+	conn *sftpConn
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if err != nil && err != io.EOF && f.r.broken(err, f.conn) {
+		return n, errConnectionLost
 	}
-	return filesInfo, nil
+	return n, err
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSH authentication methods.
+const (
+	authAgent               = "agent"
+	authPublicKey           = "publickey"
+	authKeyboardInteractive = "keyboard-interactive"
+	authPassword            = "password"
+)
+
+// sshCredentials are the settings to log in to an SSH server with.
+type sshCredentials struct {
+	User                 string
+	Password             string
+	PrivateKeyPath       string
+	PrivateKeyPassphrase string
+	// CertificatePath is the certificate of the private key signed by
+	// an SSH CA, usually the key's path followed by -cert.pub.
+	CertificatePath string
+	// AuthMethods are the methods to try, in order.
+	AuthMethods []string
+}
+
+// sshAuth authenticates the connections to an SSH server.
+type sshAuth struct {
+	user        string
+	methods     []string
+	signers     []ssh.Signer
+	password    string
+	agentSocket string
+}
+
+// newSSHAuth checks and loads the credentials, which must name a user.
+// Without explicit auth methods, the SSH agent is tried if SSH_AUTH_SOCK is
+// set, then the private key if one is set and its file exists, then the
+// password if there is one. Methods that are asked for must be usable.
+func newSSHAuth(c sshCredentials) (*sshAuth, error) {
+	if c.User == "" {
+		return nil, fmt.Errorf("no user set")
+	}
+	a := &sshAuth{user: c.User, password: c.Password, agentSocket: os.Getenv("SSH_AUTH_SOCK")}
+	explicit := len(c.AuthMethods) > 0
+	methods := c.AuthMethods
+	if !explicit {
+		if a.agentSocket != "" {
+			methods = append(methods, authAgent)
+		}
+		methods = append(methods, authPublicKey)
+		if c.Password != "" {
+			methods = append(methods, authPassword)
+		}
+	}
+	for _, method := range methods {
+		switch method {
+		case authAgent:
+			if a.agentSocket == "" {
+				return nil, fmt.Errorf("agent auth needs SSH_AUTH_SOCK to be set")
+			}
+		case authPublicKey:
+			if c.PrivateKeyPath == "" {
+				if !explicit {
+					continue
+				}
+				return nil, fmt.Errorf("publickey auth needs a private key path")
+			}
+			signers, err := loadSigners(c)
+			if os.IsNotExist(err) && !explicit {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			a.signers = signers
+		case authKeyboardInteractive, authPassword:
+			if c.Password == "" {
+				return nil, fmt.Errorf("%v auth needs a password", method)
+			}
+		default:
+			return nil, fmt.Errorf("unknown auth method %q", method)
+		}
+		a.methods = append(a.methods, method)
+	}
+	if len(a.methods) == 0 {
+		return nil, fmt.Errorf("no usable auth method")
+	}
+	return a, nil
+}
+
+// loadSigners loads the private key, and its certificate if there is one.
+func loadSigners(c sshCredentials) ([]ssh.Signer, error) {
+	key, err := ioutil.ReadFile(c.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if c.PrivateKeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(c.PrivateKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("private key %v is encrypted and no passphrase is set", c.PrivateKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("private key %v: %v", c.PrivateKeyPath, err)
+	}
+	if c.CertificatePath == "" {
+		return []ssh.Signer{signer}, nil
+	}
+	content, err := ioutil.ReadFile(c.CertificatePath)
+	if err != nil {
+		return nil, fmt.Errorf("certificate: %v", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %v: %v", c.CertificatePath, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a certificate", c.CertificatePath)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %v: %v", c.CertificatePath, err)
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// authMethods returns the auth methods for a new connection, and a function
+// to call once it is authenticated.
+//
+// The SSH client tries each kind of method once, so the keys of the agent
+// and the private key are offered by a single publickey method, in the
+// order of their methods.
+func (a *sshAuth) authMethods() ([]ssh.AuthMethod, func()) {
+	var methods []ssh.AuthMethod
+	var keySources []func() ([]ssh.Signer, error)
+	var conns []net.Conn
+	for _, method := range a.methods {
+		switch method {
+		case authAgent:
+			conn, err := net.Dial("unix", a.agentSocket)
+			if err != nil {
+				log.Printf("Could not reach SSH agent: %v", err)
+				continue
+			}
+			conns = append(conns, conn)
+			keySources = append(keySources, agent.NewClient(conn).Signers)
+		case authPublicKey:
+			signers := a.signers
+			keySources = append(keySources, func() ([]ssh.Signer, error) {
+				return signers, nil
+			})
+		case authKeyboardInteractive:
+			methods = append(methods, ssh.KeyboardInteractive(a.answer))
+		case authPassword:
+			methods = append(methods, ssh.Password(a.password))
+		}
+		if len(keySources) == 1 && (method == authAgent || method == authPublicKey) {
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				var all []ssh.Signer
+				for _, source := range keySources {
+					signers, err := source()
+					if err != nil {
+						log.Printf("Could not get keys from SSH agent: %v", err)
+						continue
+					}
+					all = append(all, signers...)
+				}
+				return all, nil
+			}))
+		}
+	}
+	return methods, func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// answer answers the hidden questions of keyboard-interactive auth with the
+// password.
+func (a *sshAuth) answer(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i := range questions {
+		if !echos[i] {
+			answers[i] = a.password
+		}
+	}
+	return answers, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// watcher reports changes to local directories, so that new input files
+// are picked up as soon as they are complete rather than at the next poll.
+type watcher interface {
+	// Watch adds a directory to the watched ones.
+	Watch(dir string) error
+	// Wait blocks until a file has been written to or moved into a
+	// watched directory since the last call, until timeout has passed or
+	// until the context is done.
+	Wait(ctx context.Context, timeout time.Duration)
+}
+
+// pollWatcher is the watcher of directories that are polled instead: it
+// only waits for the timeout.
+type pollWatcher struct{}
+
+func (pollWatcher) Watch(dir string) error {
+	return nil
+}
+
+func (pollWatcher) Wait(ctx context.Context, timeout time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	}
+}
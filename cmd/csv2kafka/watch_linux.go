@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotifyWatcher is the watcher of local directories on Linux. It is woken
+// by files closed after writing or moved into a watched directory, and by
+// new subdirectories.
+type inotifyWatcher struct {
+	f       *os.File
+	changed chan struct{}
+}
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE
+
+func newWatcher() (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		changed: make(chan struct{}, 1),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Watch(dir string) error {
+	_, err := syscall.InotifyAddWatch(int(w.f.Fd()), dir, inotifyMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) Wait(ctx context.Context, timeout time.Duration) {
+	select {
+	case <-w.changed:
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	}
+}
+
+func (w *inotifyWatcher) readEvents() {
+	var buf [4096]byte
+	for {
+		n, err := w.f.Read(buf[:])
+		if err != nil {
+			log.Println("Failed to read inotify events:", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			// Files are still being written when created; only new
+			// directories are of interest then.
+			if event.Mask&syscall.IN_CREATE != 0 && event.Mask&syscall.IN_ISDIR == 0 {
+				continue
+			}
+			select {
+			case w.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func newWatcher() (watcher, error) {
+	return nil, errors.New("directory watching is only supported on Linux")
+}
@@ -2,18 +2,27 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/linkedin/goavro/v2"
+	"github.com/sdx13/csv2kafka/internal/expr"
+	"github.com/sdx13/csv2kafka/internal/pii"
+	"github.com/sdx13/csv2kafka/internal/secret"
 	"gopkg.in/yaml.v2"
 )
 
@@ -21,11 +30,36 @@ type config struct {
 	MaxPollTimeout int `yaml:"max_poll_timeout,omitempty"`
 	Count          int `yaml:"count,omitempty"`
 	// MaxMessagesPerFile int    `yaml:"max_messages_per_file,omitempty"`
-	OutputFormat    string `yaml:"output_format,omitempty"`
-	AvroSchema      string `yaml:"avro_schema,omitempty"`
-	KafkaTopic      string `yaml:"kafka_topic,omitempty"`
-	OutputDir       string `yaml:"output_dir,omitempty"`
-	KafkaProperties string `yaml:"kafka_properties,omitempty"`
+	OutputFormat      string        `yaml:"output_format,omitempty"`
+	AvroSchema        string        `yaml:"avro_schema,omitempty"`
+	KafkaTopic        string        `yaml:"kafka_topic,omitempty"`
+	KafkaTopics       []string      `yaml:"kafka_topics,omitempty"`
+	KafkaTopicPattern string        `yaml:"kafka_topic_pattern,omitempty"`
+	Topics            []topicConfig `yaml:"topics,omitempty"`
+	OutputDir         string        `yaml:"output_dir,omitempty"`
+	KafkaProperties   string        `yaml:"kafka_properties,omitempty"`
+	Filter            string        `yaml:"filter,omitempty"`
+	DecryptFields     []string      `yaml:"decrypt_fields,omitempty"`
+	DecryptionKeyFile string        `yaml:"decryption_key_file,omitempty"`
+	TimestampLayout   string        `yaml:"timestamp_layout,omitempty"`
+	DateLayout        string        `yaml:"date_layout,omitempty"`
+	TimeZone          string        `yaml:"time_zone,omitempty"`
+	CommitInterval    int           `yaml:"commit_interval,omitempty"`
+	CommitSeconds     int           `yaml:"commit_seconds,omitempty"`
+
+	filter        *expr.Expr
+	decryptionKey []byte
+}
+
+// topicConfig overrides the schema and output file for the topics matching
+// either Name exactly or the regular expression in Pattern.
+type topicConfig struct {
+	Name       string `yaml:"name,omitempty"`
+	Pattern    string `yaml:"pattern,omitempty"`
+	AvroSchema string `yaml:"avro_schema,omitempty"`
+	OutputFile string `yaml:"output_file,omitempty"`
+
+	re *regexp.Regexp
 }
 
 func loadConfig(path string) (*config, error) {
@@ -39,6 +73,11 @@ func loadConfig(path string) (*config, error) {
 	cfg.KafkaTopic = "test"
 	cfg.OutputDir = "/home/osboxes"
 	cfg.KafkaProperties = "/home/osboxes/consumer.properties"
+	cfg.TimestampLayout = "2006-01-02 15:04:05.000"
+	cfg.DateLayout = "2006-01-02"
+	cfg.TimeZone = "UTC"
+	cfg.CommitInterval = 1000
+	cfg.CommitSeconds = 5
 
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -48,11 +87,86 @@ func loadConfig(path string) (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	for i := range cfg.Topics {
+		t := &cfg.Topics[i]
+		if t.Pattern == "" {
+			continue
+		}
+		t.re, err = regexp.Compile(anchor(t.Pattern))
+		if err != nil {
+			return nil, fmt.Errorf("topic pattern %q: %v", t.Pattern, err)
+		}
+	}
+	if cfg.Filter != "" {
+		cfg.filter, err = expr.Parse(cfg.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %v", cfg.Filter, err)
+		}
+	}
+	if len(cfg.DecryptFields) > 0 {
+		if cfg.DecryptionKeyFile == "" {
+			return nil, fmt.Errorf("decrypt_fields requires decryption_key_file")
+		}
+		cfg.decryptionKey, err = pii.LoadKey(cfg.DecryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return cfg, nil
 }
 
+// subscriptions returns the topics to subscribe to. An explicit list or
+// pattern takes precedence over the single kafka_topic setting. Patterns are
+// passed to librdkafka, which treats topics starting with "^" as regexes.
+func (cfg *config) subscriptions() []string {
+	var topics []string
+	topics = append(topics, cfg.KafkaTopics...)
+	if cfg.KafkaTopicPattern != "" {
+		topics = append(topics, anchor(cfg.KafkaTopicPattern))
+	}
+	if len(topics) == 0 {
+		topics = append(topics, cfg.KafkaTopic)
+	}
+	return topics
+}
+
+// anchor anchors a topic pattern at the start of topic names.
+func anchor(pattern string) string {
+	if strings.HasPrefix(pattern, "^") {
+		return pattern
+	}
+	return "^" + pattern
+}
+
+// topicSettings returns the schema file and output file for topic. The first
+// entry in topics matching the topic wins; otherwise the global schema is
+// used and output goes to <output_dir>/<topic>.csv, or to standard output
+// if only the single kafka_topic is consumed.
+func (cfg *config) topicSettings(topic string) (schema, output string) {
+	schema = cfg.AvroSchema
+	output = filepath.Join(cfg.OutputDir, topic+".csv")
+	if len(cfg.KafkaTopics) == 0 && cfg.KafkaTopicPattern == "" {
+		output = "-"
+	}
+	for _, t := range cfg.Topics {
+		if t.Name != topic && (t.re == nil || !t.re.MatchString(topic)) {
+			continue
+		}
+		if t.AvroSchema != "" {
+			schema = t.AvroSchema
+		}
+		if t.OutputFile != "" {
+			output = t.OutputFile
+		}
+		break
+	}
+	return schema, output
+}
+
 type AvroCodec struct {
 	codec *goavro.Codec
+	// timeFields maps fields with a time logical type to that type.
+	timeFields map[string]string
 }
 
 func NewAvroCodec(schemaFile string) (*AvroCodec, error) {
@@ -65,7 +179,11 @@ func NewAvroCodec(schemaFile string) (*AvroCodec, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &AvroCodec{codec: codec}, nil
+	fields, err := timeFields(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroCodec{codec: codec, timeFields: fields}, nil
 }
 
 func (c *AvroCodec) TextualFromBinary(binary []byte) []byte {
@@ -107,6 +225,15 @@ func loadKafkaConfig(filename string) (*kafka.ConfigMap, error) {
 		if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		}
+		// Values such as sasl.password can refer to an environment
+		// variable as ${NAME} instead of being written out.
+		if i := strings.Index(line, "="); i >= 0 {
+			value, err := secret.Expand(line[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", line[:i], err)
+			}
+			line = line[:i+1] + value
+		}
 		err := consumerMap.Set(line)
 		if err != nil {
 			return nil, err
@@ -116,40 +243,95 @@ func loadKafkaConfig(filename string) (*kafka.ConfigMap, error) {
 }
 
 type KafkaReader struct {
-	topic  string
+	topics []string
 	reader *kafka.Consumer
+
+	// sinks are synced before committing the offsets of the messages
+	// written to them. consumed counts the messages read since the last
+	// commit, made at committed.
+	sinks     *topicSinks
+	consumed  int
+	committed time.Time
 }
 
-func NewKafkaReader(cfg *config) (*KafkaReader, error) {
+func NewKafkaReader(cfg *config, sinks *topicSinks) (*KafkaReader, error) {
 	consumerMap, err := loadKafkaConfig(cfg.KafkaProperties)
 	if err != nil {
 		log.Fatalln("Could not parse kafka config", err)
 		return nil, err
 	}
+	// Offsets are only committed by commit, once the records read are
+	// written out.
+	if err := consumerMap.SetKey("enable.auto.commit", false); err != nil {
+		return nil, err
+	}
 
 	c, err := kafka.NewConsumer(consumerMap)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.SubscribeTopics([]string{cfg.KafkaTopic}, nil)
+	k := KafkaReader{
+		reader:    c,
+		sinks:     sinks,
+		committed: time.Now(),
+	}
+	k.topics = cfg.subscriptions()
+	err = c.SubscribeTopics(k.topics, k.rebalance)
 	if err != nil {
 		return nil, err
 	}
+	return &k, nil
+}
 
-	k := KafkaReader{
-		topic:  cfg.KafkaTopic,
-		reader: c,
+// rebalance commits the offsets of the messages written before partitions
+// are revoked, so that their new owner does not read them again.
+func (c *KafkaReader) rebalance(consumer *kafka.Consumer, ev kafka.Event) error {
+	if _, ok := ev.(kafka.RevokedPartitions); ok {
+		if err := c.commit(); err != nil {
+			log.Printf("Could not commit before partitions were revoked: %v", err)
+		}
 	}
-	return &k, nil
+	return nil
+}
+
+// commitDue reports whether commit_interval messages have been consumed,
+// or commit_seconds have passed, since the last commit.
+func (c *KafkaReader) commitDue(cfg *config) bool {
+	if c.consumed == 0 {
+		return false
+	}
+	if cfg.CommitInterval > 0 && c.consumed >= cfg.CommitInterval {
+		return true
+	}
+	return cfg.CommitSeconds > 0 && time.Since(c.committed) >= time.Duration(cfg.CommitSeconds)*time.Second
+}
+
+// commit syncs the output files and then commits the offsets of the
+// messages consumed so far. Nothing is committed if syncing fails.
+func (c *KafkaReader) commit() error {
+	if err := c.sinks.sync(); err != nil {
+		return err
+	}
+	_, err := c.reader.Commit()
+	if kerr, ok := err.(kafka.Error); ok && kerr.Code() == kafka.ErrNoOffset {
+		// Nothing consumed since the last commit.
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not commit offsets: %v", err)
+	}
+	c.consumed = 0
+	c.committed = time.Now()
+	return nil
 }
 
 type CsvWriter struct {
 	writer *csv.Writer
 }
 
-func NewCsvWriter() *CsvWriter {
-	w := csv.NewWriter(os.Stdout)
+func NewCsvWriter(out io.Writer) *CsvWriter {
+	w := csv.NewWriter(out)
 	return &CsvWriter{writer: w}
 }
 
@@ -158,7 +340,7 @@ func (w *CsvWriter) Write(r []string) error {
 		return err
 	}
 
-	// Write any buffered data to the underlying writer (standard output).
+	// Write any buffered data to the underlying writer.
 	w.writer.Flush()
 
 	if err := w.writer.Error(); err != nil {
@@ -196,22 +378,195 @@ func decodeFields(textual []byte) map[string]interface{} {
 	return fieldsMap
 }
 
-func consumeKafkaMessages(cfg *config, c *KafkaReader, codec *AvroCodec, w *CsvWriter) {
-	for {
-		msg, err := c.reader.ReadMessage(time.Duration(cfg.MaxPollTimeout) * time.Second)
+// topicSink holds the decoder and output for the messages of one topic.
+type topicSink struct {
+	codec  *AvroCodec
+	writer *CsvWriter
+	file   *os.File
+}
+
+// topicSinks lazily creates a sink per topic, since with a pattern
+// subscription the set of topics is only known as messages arrive. Codecs are
+// shared between topics using the same schema file.
+type topicSinks struct {
+	cfg    *config
+	sinks  map[string]*topicSink
+	codecs map[string]*AvroCodec
+}
+
+func newTopicSinks(cfg *config) *topicSinks {
+	return &topicSinks{
+		cfg:    cfg,
+		sinks:  make(map[string]*topicSink),
+		codecs: make(map[string]*AvroCodec),
+	}
+}
+
+func (s *topicSinks) get(topic string) (*topicSink, error) {
+	if sink, ok := s.sinks[topic]; ok {
+		return sink, nil
+	}
+	schema, output := s.cfg.topicSettings(topic)
+	codec, ok := s.codecs[schema]
+	if !ok {
+		var err error
+		codec, err = NewAvroCodec(schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema %v: %v", schema, err)
+		}
+		s.codecs[schema] = codec
+	}
+	sink := &topicSink{codec: codec}
+	if output == "-" {
+		sink.writer = NewCsvWriter(os.Stdout)
+	} else {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		sink.file = f
+		sink.writer = NewCsvWriter(f)
+	}
+	log.Printf("Writing topic %v to %v using schema %v", topic, output, schema)
+	s.sinks[topic] = sink
+	return sink, nil
+}
+
+// sync syncs the output files to disk. It returns an error if any could not
+// be, as their records may then be lost.
+func (s *topicSinks) sync() error {
+	for topic, sink := range s.sinks {
+		if sink.file == nil {
+			continue
+		}
+		if err := sink.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing output for topic %v: %v", topic, err)
+		}
+	}
+	return nil
+}
+
+// close syncs the output files to disk and closes them. It returns an error
+// if any could not be, as their records may then be lost.
+func (s *topicSinks) close() error {
+	var failed error
+	for topic, sink := range s.sinks {
+		if sink.file == nil {
+			continue
+		}
+		err := sink.file.Sync()
+		if closeErr := sink.file.Close(); err == nil {
+			err = closeErr
+		}
+		sink.file = nil
 		if err != nil {
-			fmt.Printf("Consumer error: %v (%v)\n", err, msg)
-			break
+			log.Printf("error closing output for topic %v: %v", topic, err)
+			failed = err
 		}
+	}
+	return failed
+}
 
-		fieldsMap := decodeFields(codec.TextualFromBinary(msg.Value))
-		err = w.Write((flatten(fieldsMap)))
+// decryptFields replaces the values of fields encrypted by csv2kafka with
+// their plain text. Values are nullable strings, so decoded either as nil or
+// as a {"string": ciphertext} union.
+func decryptFields(fieldsMap map[string]interface{}, fields []string, key []byte) error {
+	for _, name := range fields {
+		v := fieldsMap[name]
+		if union, ok := v.(map[string]interface{}); ok {
+			v = union["string"]
+		}
+		ciphertext, ok := v.(string)
+		if !ok {
+			continue
+		}
+		plaintext, err := pii.Decrypt(key, ciphertext)
 		if err != nil {
-			log.Printf("error writing record to csv: %v", err)
-			break
+			return fmt.Errorf("decrypting %v: %v", name, err)
 		}
+		fieldsMap[name] = string(plaintext)
 	}
-	c.reader.Close()
+	return nil
+}
+
+// pollInterval bounds how long a signal may wait for a poll to return.
+const pollInterval = time.Second
+
+// consumeKafkaMessages writes the consumed messages to their sinks until
+// none has arrived for max_poll_timeout seconds, unless it is negative, or
+// the context is done, committing their offsets as they become due. It
+// returns an error if consuming, writing or committing failed.
+func consumeKafkaMessages(ctx context.Context, cfg *config, c *KafkaReader, sinks *topicSinks, times *timeFormatter) error {
+	maxIdle := time.Duration(cfg.MaxPollTimeout) * time.Second
+	poll := pollInterval
+	if maxIdle >= 0 && maxIdle < poll {
+		poll = maxIdle
+	}
+	var idle time.Duration
+	for ctx.Err() == nil {
+		if c.commitDue(cfg) {
+			if err := c.commit(); err != nil {
+				return err
+			}
+		}
+		msg, err := c.reader.ReadMessage(poll)
+		if kerr, ok := err.(kafka.Error); ok && kerr.Code() == kafka.ErrTimedOut {
+			idle += poll
+			if maxIdle < 0 || idle < maxIdle {
+				continue
+			}
+			log.Printf("No messages for %v, exiting", maxIdle)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("consumer error: %v (%v)", err, msg)
+		}
+		idle = 0
+		c.consumed++
+
+		topic := *msg.TopicPartition.Topic
+		sink, err := sinks.get(topic)
+		if err != nil {
+			log.Printf("skipping message from topic %v: %v", topic, err)
+			continue
+		}
+		fieldsMap := decodeFields(sink.codec.TextualFromBinary(msg.Value))
+		err = decryptFields(fieldsMap, cfg.DecryptFields, cfg.decryptionKey)
+		if err != nil {
+			log.Printf("skipping message at %v: %v", msg.TopicPartition, err)
+			continue
+		}
+		if cfg.filter != nil {
+			keep, err := cfg.filter.Match(fieldsMap)
+			if err != nil {
+				log.Printf("skipping message at %v: filter: %v", msg.TopicPartition, err)
+				continue
+			}
+			if !keep {
+				continue
+			}
+		}
+		err = times.format(fieldsMap, sink.codec.timeFields)
+		if err != nil {
+			log.Printf("skipping message at %v: %v", msg.TopicPartition, err)
+			continue
+		}
+		err = sink.writer.Write((flatten(fieldsMap)))
+		if err != nil {
+			return fmt.Errorf("error writing record to csv: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close commits the offsets of the messages consumed so far and closes the
+// consumer. It is called once their records are safely written out.
+func (c *KafkaReader) Close() error {
+	err := c.commit()
+	if closeErr := c.reader.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func main() {
@@ -224,18 +579,43 @@ func main() {
 		log.Fatalf("config %v", err)
 	}
 
-	// Read schema file
-	codec, err := NewAvroCodec(cfg.AvroSchema)
+	times, err := newTimeFormatter(cfg)
 	if err != nil {
-		log.Fatalln("Could not parse schema", err)
+		log.Fatalf("config %v", err)
 	}
 
-	consumer, err := NewKafkaReader(cfg)
+	// The output is synced before the offsets are committed, so that a
+	// record is never both lost and marked as consumed.
+	sinks := newTopicSinks(cfg)
+	consumer, err := NewKafkaReader(cfg, sinks)
 	if err != nil {
 		log.Fatalln("Could not create Kafka consumer")
 	}
 
-	writer := NewCsvWriter()
-
-	consumeKafkaMessages(cfg, consumer, codec, writer)
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		cancel()
+		sig = <-signals
+		log.Printf("Received %v again, exiting immediately", sig)
+		os.Exit(130)
+	}()
+
+	status := 0
+	if err := consumeKafkaMessages(ctx, cfg, consumer, sinks, times); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := sinks.close(); err != nil {
+		// Skip the final commit so that the last messages are read again.
+		os.Exit(1)
+	}
+	if err := consumer.Close(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	os.Exit(status)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Avro logical types that are formatted as human-readable times.
+const (
+	typeTimestampMillis = "timestamp-millis"
+	typeTimestampMicros = "timestamp-micros"
+	typeDate            = "date"
+)
+
+// timeFields returns the top-level fields of a record schema that have a
+// time logical type, possibly inside a union, keyed by field name.
+func timeFields(schema []byte) (map[string]string, error) {
+	var record struct {
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(schema, &record); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	for _, f := range record.Fields {
+		var branches []json.RawMessage
+		if err := json.Unmarshal(f.Type, &branches); err != nil {
+			branches = []json.RawMessage{f.Type}
+		}
+		for _, b := range branches {
+			var t struct {
+				LogicalType string `json:"logicalType"`
+			}
+			if json.Unmarshal(b, &t) != nil {
+				continue
+			}
+			switch t.LogicalType {
+			case typeTimestampMillis, typeTimestampMicros, typeDate:
+				fields[f.Name] = t.LogicalType
+			}
+		}
+	}
+	return fields, nil
+}
+
+// timeFormatter formats the values of time fields, which the Avro JSON
+// encoding gives as numbers, using a layout and zone. Dates are calendar
+// dates and are not converted between zones.
+type timeFormatter struct {
+	layout     string
+	dateLayout string
+	location   *time.Location
+}
+
+func newTimeFormatter(cfg *config) (*timeFormatter, error) {
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("time zone: %v", err)
+	}
+	return &timeFormatter{
+		layout:     cfg.TimestampLayout,
+		dateLayout: cfg.DateLayout,
+		location:   loc,
+	}, nil
+}
+
+func (f *timeFormatter) format(fieldsMap map[string]interface{}, fields map[string]string) error {
+	for name, logicalType := range fields {
+		v := fieldsMap[name]
+		if union, ok := v.(map[string]interface{}); ok {
+			for _, v = range union {
+			}
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return fmt.Errorf("field %v: %v", name, err)
+		}
+		switch logicalType {
+		case typeTimestampMillis:
+			fieldsMap[name] = time.Unix(0, i*int64(time.Millisecond)).In(f.location).Format(f.layout)
+		case typeTimestampMicros:
+			fieldsMap[name] = time.Unix(0, i*int64(time.Microsecond)).In(f.location).Format(f.layout)
+		case typeDate:
+			fieldsMap[name] = time.Unix(i*24*60*60, 0).UTC().Format(f.dateLayout)
+		}
+	}
+	return nil
+}
@@ -3,7 +3,7 @@ module github.com/sdx13/csv2kafka
 go 1.15
 
 require (
-	github.com/confluentinc/confluent-kafka-go v1.8.2 // indirect
+	github.com/confluentinc/confluent-kafka-go v1.8.2
 	github.com/linkedin/goavro/v2 v2.11.1
 	github.com/pkg/sftp v1.13.4
 	golang.org/x/crypto v0.0.0-20220408190544-5352b0902921
@@ -0,0 +1,473 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type node interface {
+	eval(fields map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct {
+	v interface{}
+}
+
+func (n *literalNode) eval(map[string]interface{}) (interface{}, error) {
+	return n.v, nil
+}
+
+// fieldNode looks up a possibly dotted field name. Missing fields evaluate to
+// null.
+type fieldNode struct {
+	path []string
+}
+
+func (n *fieldNode) eval(fields map[string]interface{}) (interface{}, error) {
+	var v interface{} = fields
+	for _, name := range n.path {
+		m, ok := v.(map[string]interface{})
+		for ok {
+			if inner, found := m[name]; found {
+				v = inner
+				break
+			}
+			// Step into a union wrapping a nested record.
+			m, ok = unwrapOnce(m)
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	return normalize(v), nil
+}
+
+type negNode struct {
+	operand node
+}
+
+func (n *negNode) eval(fields map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case int64:
+		return -v, nil
+	case float64:
+		return -v, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot negate %T", v)
+}
+
+// arithNode implements the binary arithmetic operators. Integer operands
+// give integer results, mixing in a float gives a float, and "+" with a
+// string operand concatenates. A null operand makes the result null.
+type arithNode struct {
+	op          string
+	left, right node
+}
+
+func (n *arithNode) eval(fields map[string]interface{}) (interface{}, error) {
+	l, err := n.left.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	_, ls := l.(string)
+	_, rs := r.(string)
+	if ls || rs {
+		if n.op != "+" {
+			return nil, fmt.Errorf("operator %q not defined on strings", n.op)
+		}
+		return toString(l) + toString(r), nil
+	}
+	li, lint := l.(int64)
+	ri, rint := r.(int64)
+	if lint && rint {
+		switch n.op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		}
+		if ri == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if n.op == "/" {
+			return li / ri, nil
+		}
+		return li % ri, nil
+	}
+	lf, err := toFloat(l)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := toFloat(r)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		return lf / rf, nil
+	}
+	return math.Mod(lf, rf), nil
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(fields map[string]interface{}) (interface{}, error) {
+	b, err := evalBool(n.operand, fields)
+	if err != nil {
+		return nil, err
+	}
+	return !b, nil
+}
+
+type logicalNode struct {
+	or          bool
+	left, right node
+}
+
+func (n *logicalNode) eval(fields map[string]interface{}) (interface{}, error) {
+	l, err := evalBool(n.left, fields)
+	if err != nil {
+		return nil, err
+	}
+	if l == n.or {
+		return l, nil
+	}
+	return evalBool(n.right, fields)
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(fields map[string]interface{}) (interface{}, error) {
+	l, err := n.left.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	}
+	// Ordering against null is never true, as in SQL.
+	if l == nil || r == nil {
+		return false, nil
+	}
+	c, err := compare(l, r)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+type matchNode struct {
+	negate  bool
+	operand node
+	re      *regexp.Regexp
+}
+
+func (n *matchNode) eval(fields map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return n.negate, nil
+	}
+	return n.re.MatchString(fmt.Sprint(v)) != n.negate, nil
+}
+
+type nullNode struct {
+	negate  bool
+	operand node
+}
+
+func (n *nullNode) eval(fields map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != n.negate, nil
+}
+
+// betweenNode tests low <= operand <= high.
+type betweenNode struct {
+	negate             bool
+	operand, low, high node
+}
+
+func (n *betweenNode) eval(fields map[string]interface{}) (interface{}, error) {
+	vals := make([]interface{}, 3)
+	for i, o := range []node{n.operand, n.low, n.high} {
+		v, err := o.eval(fields)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return false, nil
+		}
+		vals[i] = v
+	}
+	lc, err := compare(vals[0], vals[1])
+	if err != nil {
+		return nil, err
+	}
+	hc, err := compare(vals[0], vals[2])
+	if err != nil {
+		return nil, err
+	}
+	return (lc >= 0 && hc <= 0) != n.negate, nil
+}
+
+type inNode struct {
+	negate  bool
+	operand node
+	list    []node
+}
+
+func (n *inNode) eval(fields map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range n.list {
+		e, err := o.eval(fields)
+		if err != nil {
+			return nil, err
+		}
+		if equal(v, e) {
+			return !n.negate, nil
+		}
+	}
+	return n.negate, nil
+}
+
+func evalBool(n node, fields map[string]interface{}) (bool, error) {
+	v, err := n.eval(fields)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected boolean, got %T", v)
+	}
+	return b, nil
+}
+
+// unwrap strips the single-entry maps that goavro and the Avro JSON encoding
+// use to represent union values, e.g. {"long": 42}. Other single-entry maps,
+// such as records of one field, are left as they are.
+func unwrap(v interface{}) interface{} {
+	for {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		inner, ok := unionValue(m)
+		if !ok {
+			return v
+		}
+		v = inner
+	}
+}
+
+func unwrapOnce(m map[string]interface{}) (map[string]interface{}, bool) {
+	v, ok := unionValue(m)
+	if !ok {
+		return nil, false
+	}
+	inner, ok := v.(map[string]interface{})
+	return inner, ok
+}
+
+// unionValue returns the value of a union, a map from the name of the
+// branch's type to the value.
+func unionValue(m map[string]interface{}) (interface{}, bool) {
+	if len(m) != 1 {
+		return nil, false
+	}
+	for name, v := range m {
+		if isBranchName(name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// isBranchName reports whether name can name the type of a union branch: a
+// primitive type, an array or map, or a named type qualified by its
+// namespace. Named types
+// without a namespace cannot be told from field names, so unions of them are
+// not unwrapped.
+func isBranchName(name string) bool {
+	switch name {
+	case "null", "boolean", "int", "long", "float", "double", "bytes", "string", "array", "map":
+		return true
+	}
+	return strings.Contains(name, ".")
+}
+
+// normalize converts a native Avro or JSON decoded value into one of the
+// types the evaluator works with: nil, bool, int64, float64, string or a
+// map for records.
+func normalize(v interface{}) interface{} {
+	switch v := unwrap(v).(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UnixNano() / int64(time.Millisecond)
+	default:
+		return v
+	}
+}
+
+func equal(l, r interface{}) bool {
+	if l == nil || r == nil {
+		return l == nil && r == nil
+	}
+	c, err := compare(l, r)
+	return err == nil && c == 0
+}
+
+func compare(l, r interface{}) (int, error) {
+	switch l := l.(type) {
+	case int64:
+		switch r := r.(type) {
+		case int64:
+			return compareInt(l, r), nil
+		case float64:
+			return compareFloat(float64(l), r), nil
+		}
+	case float64:
+		switch r := r.(type) {
+		case int64:
+			return compareFloat(l, float64(r)), nil
+		case float64:
+			return compareFloat(l, r), nil
+		}
+	case string:
+		if r, ok := r.(string); ok {
+			switch {
+			case l < r:
+				return -1, nil
+			case l > r:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case bool:
+		if r, ok := r.(bool); ok {
+			if l == r {
+				return 0, nil
+			}
+			if !l {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T with %T", l, r)
+}
+
+func compareInt(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("expected number, got %T", v)
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
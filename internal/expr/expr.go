@@ -0,0 +1,57 @@
+// Package expr implements the small expression language used to filter
+// records and compute derived fields in csv2kafka and kafka2csv.
+//
+// Expressions are evaluated against a record in the form produced by goavro
+// or by decoding Avro JSON, so union values such as {"long": 42} are
+// unwrapped transparently. Branches of named types are only unwrapped if
+// the name includes a namespace, as single-entry maps are otherwise taken to
+// be records of one field or Avro maps. Examples:
+//
+//	mobile_phone not in [2222200315, 2222200316]
+//	start_time between 1530900000 and 1530986400 && end_time is not null
+//	mobile_phone =~ '^22' or (start_time >= 0 and not (end_time < 0))
+//	end_time - start_time
+//	concat("feed-", lower(capture(_file, '^([A-Z]+)_')), "-", sha256(mobile_phone))
+package expr
+
+import (
+	"fmt"
+)
+
+// Expr is a parsed expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses src into an expression.
+func Parse(src string) (*Expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %v", t)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// Eval evaluates the expression against fields.
+func (e *Expr) Eval(fields map[string]interface{}) (interface{}, error) {
+	return e.root.eval(fields)
+}
+
+// Match evaluates the expression against fields and reports whether it is
+// true. It is an error for the expression not to evaluate to a boolean.
+func (e *Expr) Match(fields map[string]interface{}) (bool, error) {
+	return evalBool(e.root, fields)
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
@@ -0,0 +1,191 @@
+package expr
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var testFields = map[string]interface{}{
+	"a":       int64(2),
+	"b":       int64(3),
+	"f":       1.5,
+	"s":       "abc",
+	"phone":   map[string]interface{}{"long": int64(2222200315)},
+	"name":    map[string]interface{}{"string": "x"},
+	"missing": nil,
+	"rec": map[string]interface{}{
+		"com.example.Inner": map[string]interface{}{
+			"n": map[string]interface{}{"int": int32(7)},
+		},
+	},
+	"num":    json.Number("12"),
+	"one":    map[string]interface{}{"x": int64(5)},
+	"labels": map[string]interface{}{"env": "prod"},
+	"tags": map[string]interface{}{
+		"map": map[string]interface{}{"env": "prod"},
+	},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// Precedence.
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"10 - 4 - 3", int64(3)},
+		{"7 % 4 * 2", int64(6)},
+		{"-a + 1", int64(-1)},
+		{"a + b * 2 == 8", true},
+		{"true or false and false", true},
+		{"(true or false) and false", false},
+		{"not a == 2", false},
+		{"not a == 2 or b == 3", true},
+		{"!(a == 2 and b == 4)", true},
+		{"a < b && b < 4 || false", true},
+
+		// Arithmetic.
+		{"a / b", int64(0)},
+		{"a * f", 3.0},
+		{"s + 1", "abc1"},
+
+		// Comparisons and matches.
+		{"s == 'abc'", true},
+		{"s != \"abc\"", false},
+		{"f >= 1.5", true},
+		{"a < f", false},
+		{"s =~ '^a'", true},
+		{"s !~ '^a'", false},
+
+		// between and in, negated.
+		{"a between 1 and 3", true},
+		{"a between 3 and 4", false},
+		{"a not between 3 and 4", true},
+		{"a not between 1 and 3", false},
+		{"a in [1, 2, 3]", true},
+		{"a in [4, 5]", false},
+		{"a not in [4, 5]", true},
+		{"a not in [1, 2]", false},
+		{"s in ['x', 'abc']", true},
+
+		// Null semantics.
+		{"missing is null", true},
+		{"undefined is null", true},
+		{"a is not null", true},
+		{"missing + 1", nil},
+		{"-missing", nil},
+		{"missing == null", true},
+		{"missing == 1", false},
+		{"missing != 1", true},
+		{"missing < 1", false},
+		{"missing >= 1", false},
+		{"missing between 1 and 3", false},
+		{"missing not between 1 and 3", false},
+		{"a between missing and 3", false},
+		{"missing in [1, 2]", false},
+		{"missing =~ 'x'", false},
+		{"missing !~ 'x'", true},
+
+		// Union unwrapping.
+		{"phone", int64(2222200315)},
+		{"phone in [2222200315, 2222200316]", true},
+		{"phone not in [2222200315]", false},
+		{"name == 'x'", true},
+		{"rec.n", int64(7)},
+		{"rec.n + 1", int64(8)},
+		{"rec.missing is null", true},
+		{"num * 2", int64(24)},
+
+		// Single-entry maps that are not unions.
+		{"one.x", int64(5)},
+		{"one.x + 1", int64(6)},
+		{"one", map[string]interface{}{"x": int64(5)}},
+		{"one.missing is null", true},
+		{"labels.env", "prod"},
+		{"labels", map[string]interface{}{"env": "prod"}},
+
+		// A union holding a map.
+		{"tags.env", "prod"},
+		{"tags", map[string]interface{}{"env": "prod"}},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := e.Eval(testFields)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Eval(%q) = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1",
+		"a not 1",
+		"a between 1",
+		"a in 1, 2",
+		"a in [1,",
+		"a =~ b",
+		"a =~ '('",
+		"a is 1",
+		"1 2",
+		"and",
+		"'unterminated",
+		"nosuchfunc(1)",
+	}
+	for _, src := range tests {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []string{
+		"a / 0",
+		"a % 0",
+		"s - 1",
+		"-s",
+		"s < 1",
+		"a between 's' and 3",
+	}
+	for _, src := range tests {
+		e, err := Parse(src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", src, err)
+			continue
+		}
+		if _, err := e.Eval(testFields); err == nil {
+			t.Errorf("Eval(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	e, err := Parse("a + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Match(testFields); err == nil {
+		t.Error("Match of a non-boolean expression succeeded, want an error")
+	}
+	e, err = Parse("phone not in [2222200316] and name is not null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := e.Match(testFields)
+	if err != nil || !ok {
+		t.Errorf("Match() = %v, %v, want true", ok, err)
+	}
+}
@@ -0,0 +1,256 @@
+package expr
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type function struct {
+	minArgs, maxArgs int
+	fn               func(args []interface{}) (interface{}, error)
+}
+
+// functions maps the names usable in expressions to their implementations.
+// Unless noted otherwise a null argument makes the result null.
+var functions = map[string]function{
+	"concat":   {1, -1, fnConcat},
+	"lower":    {1, 1, fnLower},
+	"upper":    {1, 1, fnUpper},
+	"trim":     {1, 1, fnTrim},
+	"substr":   {2, 3, fnSubstr},
+	"length":   {1, 1, fnLength},
+	"coalesce": {1, -1, fnCoalesce},
+	"string":   {1, 1, fnString},
+	"long":     {1, 1, fnLong},
+	"double":   {1, 1, fnDouble},
+	"md5":      {1, 1, hashFunc(md5.New)},
+	"sha1":     {1, 1, hashFunc(sha1.New)},
+	"sha256":   {1, 1, hashFunc(sha256.New)},
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func newCallNode(name string, args []node) (node, error) {
+	if name == "capture" {
+		return newCaptureNode(args)
+	}
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	if len(args) < fn.minArgs || fn.maxArgs >= 0 && len(args) > fn.maxArgs {
+		return nil, fmt.Errorf("wrong number of arguments to %v", name)
+	}
+	return &callNode{name: name, fn: fn, args: args}, nil
+}
+
+func (n *callNode) eval(fields map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(fields)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", n.name, err)
+	}
+	return v, nil
+}
+
+// captureNode implements capture(s, regexp [, group]), which returns the
+// given submatch of the regular expression in s, or null if it does not
+// match. The group defaults to 1, or to the whole match if the expression
+// has no groups. The regular expression must be a string literal so that
+// it is compiled only once.
+type captureNode struct {
+	operand node
+	re      *regexp.Regexp
+	group   int
+}
+
+func newCaptureNode(args []node) (node, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("wrong number of arguments to capture")
+	}
+	pattern, ok := literal(args[1]).(string)
+	if !ok {
+		return nil, fmt.Errorf("capture: regular expression must be a string literal")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("capture: %v", err)
+	}
+	n := &captureNode{operand: args[0], re: re}
+	if re.NumSubexp() > 0 {
+		n.group = 1
+	}
+	if len(args) == 3 {
+		group, ok := literal(args[2]).(int64)
+		if !ok || group < 0 {
+			return nil, fmt.Errorf("capture: group must be a non-negative integer literal")
+		}
+		n.group = int(group)
+	}
+	if n.group > re.NumSubexp() {
+		return nil, fmt.Errorf("capture: regular expression has no group %d", n.group)
+	}
+	return n, nil
+}
+
+func (n *captureNode) eval(fields map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(fields)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	m := n.re.FindStringSubmatch(toString(v))
+	if m == nil {
+		return nil, nil
+	}
+	return m[n.group], nil
+}
+
+// literal returns the value of n if it is a literal, or nil otherwise.
+func literal(n node) interface{} {
+	if lit, ok := n.(*literalNode); ok {
+		return lit.v
+	}
+	return nil
+}
+
+func fnConcat(args []interface{}) (interface{}, error) {
+	var b strings.Builder
+	for _, a := range args {
+		b.WriteString(toString(a))
+	}
+	return b.String(), nil
+}
+
+func fnLower(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	return strings.ToLower(toString(args[0])), nil
+}
+
+func fnUpper(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	return strings.ToUpper(toString(args[0])), nil
+}
+
+func fnTrim(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	return strings.TrimSpace(toString(args[0])), nil
+}
+
+// fnSubstr implements substr(s, start [, length]) with a zero-based start,
+// clamped to the bounds of s.
+func fnSubstr(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	s := []rune(toString(args[0]))
+	start, ok := args[1].(int64)
+	if !ok {
+		return nil, fmt.Errorf("start must be an integer")
+	}
+	end := int64(len(s))
+	if len(args) == 3 {
+		n, ok := args[2].(int64)
+		if !ok {
+			return nil, fmt.Errorf("length must be an integer")
+		}
+		end = start + n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > int64(len(s)) {
+		end = int64(len(s))
+	}
+	if start >= end {
+		return "", nil
+	}
+	return string(s[start:end]), nil
+}
+
+func fnLength(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	return int64(len([]rune(toString(args[0])))), nil
+}
+
+// fnCoalesce returns the first non-null argument.
+func fnCoalesce(args []interface{}) (interface{}, error) {
+	for _, a := range args {
+		if a != nil {
+			return a, nil
+		}
+	}
+	return nil, nil
+}
+
+func fnString(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	return toString(args[0]), nil
+}
+
+func fnLong(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return strconv.ParseInt(strings.TrimSpace(toString(args[0])), 10, 64)
+}
+
+func fnDouble(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	if s, ok := args[0].(string); ok {
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	}
+	return toFloat(args[0])
+}
+
+// hashFunc returns a function giving the lower case hex digest of the string
+// form of its argument.
+func hashFunc(h func() hash.Hash) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		d := h()
+		d.Write([]byte(toString(args[0])))
+		return hex.EncodeToString(d.Sum(nil)), nil
+	}
+}
@@ -0,0 +1,297 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Grammar, loosest binding first:
+//
+//	expr    = and { ("||" | "or") and }
+//	and     = not { ("&&" | "and") not }
+//	not     = ("!" | "not") not | cmp
+//	cmp     = sum [ ("==" | "!=" | "<" | "<=" | ">" | ">=") sum
+//	              | ("=~" | "!~") string
+//	              | "is" ["not"] "null"
+//	              | ["not"] "between" sum "and" sum
+//	              | ["not"] "in" "[" sum { "," sum } "]" ]
+//	sum     = term { ("+" | "-") term }
+//	term    = operand { ("*" | "/" | "%") operand }
+//	operand = number | string | "true" | "false" | "null" | field
+//	        | func "(" [ expr { "," expr } ] ")"
+//	        | "-" operand | "(" expr ")"
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator or keyword text.
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokOp || t.kind == tokIdent) && strings.EqualFold(t.text, text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected %q, found %v", text, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") || p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") || p.accept("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept("!") || p.accept("not") {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *parser) parseCmp() (node, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && isComparison(t.text):
+		p.next()
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: t.text, left: left, right: right}, nil
+	case t.kind == tokOp && (t.text == "=~" || t.text == "!~"):
+		p.next()
+		s := p.next()
+		if s.kind != tokString {
+			return nil, fmt.Errorf("expected regular expression string, found %v", s)
+		}
+		re, err := regexp.Compile(s.text)
+		if err != nil {
+			return nil, err
+		}
+		return &matchNode{negate: t.text == "!~", operand: left, re: re}, nil
+	case p.accept("is"):
+		negate := p.accept("not")
+		if err := p.expect("null"); err != nil {
+			return nil, err
+		}
+		return &nullNode{negate: negate, operand: left}, nil
+	}
+
+	negate := p.accept("not")
+	switch {
+	case p.accept("between"):
+		low, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("and"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &betweenNode{negate: negate, operand: left, low: low, high: high}, nil
+	case p.accept("in"):
+		if err := p.expect("["); err != nil {
+			return nil, err
+		}
+		n := &inNode{negate: negate, operand: left}
+		for {
+			v, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, v)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case negate:
+		return nil, fmt.Errorf("expected \"between\" or \"in\" after \"not\", found %v", p.peek())
+	}
+	return left, nil
+}
+
+func (p *parser) parseSum() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || t.text != "+" && t.text != "-" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseTerm() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || t.text != "*" && t.text != "/" && t.text != "%" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &literalNode{i}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %v", t)
+		}
+		return &literalNode{f}, nil
+	case tokString:
+		return &literalNode{t.text}, nil
+	case tokIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if isKeyword(t.text) {
+			return nil, fmt.Errorf("unexpected keyword %v", t)
+		}
+		if p.accept("(") {
+			return p.parseCall(t)
+		}
+		return &fieldNode{path: strings.Split(t.text, ".")}, nil
+	case tokOp:
+		if t.text == "-" {
+			n, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return &negNode{n}, nil
+		}
+		if t.text == "(" {
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %v", t)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	var args []node
+	if !p.accept(")") {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	return newCallNode(strings.ToLower(name.text), args)
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func isKeyword(s string) bool {
+	switch strings.ToLower(s) {
+	case "and", "or", "not", "is", "between", "in":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+// Package pii provides the primitives used to protect personally
+// identifiable information in records: keyed tokenisation, partial masking
+// and reversible encryption.
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+)
+
+// LoadKey reads a key from path. The file holds either the raw key bytes or
+// their hex encoding; surrounding whitespace is ignored in the latter case.
+func LoadKey(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(content))
+	if key, err := hex.DecodeString(text); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	if len(content) == 0 {
+		return nil, fmt.Errorf("key file %v is empty", path)
+	}
+	return content, nil
+}
+
+// Token returns the hex encoded HMAC-SHA256 of value under key. Equal values
+// give equal tokens, so tokenised fields can still be joined and counted.
+func Token(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Mask replaces every letter and digit of value except the last keep ones
+// with maskChar. Other characters such as separators are left alone, so the
+// result has the same length and shape as the input.
+func Mask(value string, keep int, maskChar rune) string {
+	runes := []rune(value)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		runes[i] = maskChar
+	}
+	return string(runes)
+}
+
+// Encrypt encrypts plaintext with AES-GCM under key, which must be 16, 24 or
+// 32 bytes long, and returns the base64 encoded nonce and ciphertext.
+func Encrypt(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt.
+func Decrypt(key []byte, ciphertext string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
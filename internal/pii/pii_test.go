@@ -0,0 +1,131 @@
+package pii
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		value string
+		keep  int
+		want  string
+	}{
+		{"2222200315", 4, "******0315"},
+		{"2222200315", 0, "**********"},
+		{"123", 5, "123"},
+		{"+44 (20) 7946-0958", 4, "+** (**) ****-0958"},
+		{"john.doe@example.com", 3, "****.***@*******.com"},
+		{"", 2, ""},
+		{"Zoë", 1, "**ë"},
+	}
+	for _, tt := range tests {
+		if got := Mask(tt.value, tt.keep, '*'); got != tt.want {
+			t.Errorf("Mask(%q, %d) = %q, want %q", tt.value, tt.keep, got, tt.want)
+		}
+	}
+	if got := Mask("1234", 1, '#'); got != "###4" {
+		t.Errorf("Mask with '#' = %q, want ###4", got)
+	}
+}
+
+func TestToken(t *testing.T) {
+	key := []byte("key")
+	tok := Token(key, "2222200315")
+	tests := []struct {
+		name  string
+		token string
+		same  bool
+	}{
+		{"same value and key", Token(key, "2222200315"), true},
+		{"other value", Token(key, "2222200316"), false},
+		{"other key", Token([]byte("other"), "2222200315"), false},
+	}
+	for _, tt := range tests {
+		if (tt.token == tok) != tt.same {
+			t.Errorf("%v: token %v, equal to %v = %v, want %v", tt.name, tt.token, tok, !tt.same, tt.same)
+		}
+	}
+	if len(tok) != 64 {
+		t.Errorf("token %v has length %d, want 64", tok, len(tok))
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, size := range []int{16, 24, 32} {
+		key := bytes.Repeat([]byte{1}, size)
+		for _, plaintext := range []string{"", "2222200315", "naïve"} {
+			ciphertext, err := Encrypt(key, []byte(plaintext))
+			if err != nil {
+				t.Fatalf("Encrypt with a %d byte key: %v", size, err)
+			}
+			got, err := Decrypt(key, ciphertext)
+			if err != nil {
+				t.Fatalf("Decrypt with a %d byte key: %v", size, err)
+			}
+			if string(got) != plaintext {
+				t.Errorf("Decrypt(Encrypt(%q)) = %q", plaintext, got)
+			}
+		}
+	}
+
+	key := bytes.Repeat([]byte{1}, 16)
+	a, _ := Encrypt(key, []byte("x"))
+	b, _ := Encrypt(key, []byte("x"))
+	if a == b {
+		t.Error("Encrypt gave the same ciphertext twice, want a fresh nonce each time")
+	}
+
+	errTests := []struct {
+		name       string
+		key        []byte
+		ciphertext string
+	}{
+		{"wrong key", bytes.Repeat([]byte{2}, 16), a},
+		{"bad key size", []byte("short"), a},
+		{"not base64", key, "%%%"},
+		{"too short", key, "AAAA"},
+		{"tampered", key, a[:len(a)-4] + "AAAA"},
+	}
+	for _, tt := range errTests {
+		if _, err := Decrypt(tt.key, tt.ciphertext); err == nil {
+			t.Errorf("Decrypt with %v succeeded, want an error", tt.name)
+		}
+	}
+	if _, err := Encrypt([]byte("short"), nil); err == nil {
+		t.Error("Encrypt with a 5 byte key succeeded, want an error")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		want    []byte
+		wantErr bool
+	}{
+		{"00112233445566778899aabbccddeeff\n", []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, false},
+		{"  0a0b  ", []byte{0x0a, 0x0b}, false},
+		{"raw key bytes!!!", []byte("raw key bytes!!!"), false},
+		{"", nil, true},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := LoadKey(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LoadKey(%q) error = %v, want error %v", tt.content, err, tt.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("LoadKey(%q) = %x, want %x", tt.content, got, tt.want)
+		}
+	}
+	if _, err := LoadKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("LoadKey of a missing file succeeded, want an error")
+	}
+}
@@ -0,0 +1,86 @@
+// Package secret resolves the credentials given in config files, which can
+// refer to environment variables or files instead of holding them, and keeps
+// them out of logs.
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Redacted stands for a secret in logged config.
+const Redacted = "<redacted>"
+
+var envRef = regexp.MustCompile(`^\$\{(\w+)\}$`)
+
+// Expand returns the value of the environment variable that value refers to
+// as ${NAME}, or value itself if it is not such a reference. A reference to
+// an unset variable is an error.
+func Expand(value string) (string, error) {
+	m := envRef.FindStringSubmatch(value)
+	if m == nil {
+		return value, nil
+	}
+	v, ok := os.LookupEnv(m[1])
+	if !ok {
+		return "", fmt.Errorf("environment variable %v is not set", m[1])
+	}
+	return v, nil
+}
+
+// ReadFile reads a secret from path, without the trailing newline.
+func ReadFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Value is a secret setting. It is decoded from YAML with Expand, and
+// encoded and printed redacted.
+type Value string
+
+func (v *Value) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	s, err := Expand(s)
+	if err != nil {
+		return err
+	}
+	*v = Value(s)
+	return nil
+}
+
+func (v Value) MarshalYAML() (interface{}, error) {
+	return v.String(), nil
+}
+
+func (v Value) String() string {
+	if v == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// Resolve sets v to the content of the file at path, if path is set. Setting
+// both is an error.
+func (v *Value) Resolve(path string) error {
+	if path == "" {
+		return nil
+	}
+	if *v != "" {
+		return fmt.Errorf("both the secret and its file %v are set", path)
+	}
+	s, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	*v = Value(s)
+	return nil
+}
@@ -0,0 +1,133 @@
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExpand(t *testing.T) {
+	os.Setenv("SECRET_TEST_SET", "s3cret")
+	os.Setenv("SECRET_TEST_EMPTY", "")
+	os.Unsetenv("SECRET_TEST_UNSET")
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "plain", false},
+		{"", "", false},
+		{"${SECRET_TEST_SET}", "s3cret", false},
+		{"${SECRET_TEST_EMPTY}", "", false},
+		{"${SECRET_TEST_UNSET}", "", true},
+		// Only a whole value is a reference.
+		{"x${SECRET_TEST_SET}", "x${SECRET_TEST_SET}", false},
+		{"${SECRET_TEST_SET}x", "${SECRET_TEST_SET}x", false},
+		{"$SECRET_TEST_SET", "$SECRET_TEST_SET", false},
+		{"${NOT-A-NAME}", "${NOT-A-NAME}", false},
+	}
+	for _, tt := range tests {
+		got, err := Expand(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Expand(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		value   Value
+		path    string
+		want    Value
+		wantErr bool
+	}{
+		{"inline", "", "inline", false},
+		{"", "", "", false},
+		{"", write("newline", "from file\n"), "from file", false},
+		{"", write("crlf", "from file\r\n"), "from file", false},
+		{"", write("spaces", " padded \n"), " padded ", false},
+		{"", write("multi", "line 1\nline 2\n"), "line 1\nline 2", false},
+		{"", filepath.Join(dir, "missing"), "", true},
+		{"inline", write("both", "from file"), "inline", true},
+	}
+	for _, tt := range tests {
+		v := tt.value
+		err := v.Resolve(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Resolve(%q) of %q error = %v, want error %v", tt.path, string(tt.value), err, tt.wantErr)
+			continue
+		}
+		if v != tt.want {
+			t.Errorf("Resolve(%q) of %q = %q, want %q", tt.path, string(tt.value), string(v), string(tt.want))
+		}
+	}
+}
+
+func TestValueYAML(t *testing.T) {
+	os.Setenv("SECRET_TEST_PASSWORD", "hunter2")
+	os.Unsetenv("SECRET_TEST_UNSET")
+	type settings struct {
+		User     string `yaml:"user"`
+		Password Value  `yaml:"password,omitempty"`
+	}
+	tests := []struct {
+		in      string
+		want    Value
+		wantErr bool
+	}{
+		{"user: u\npassword: plain\n", "plain", false},
+		{"user: u\npassword: ${SECRET_TEST_PASSWORD}\n", "hunter2", false},
+		{"user: u\n", "", false},
+		{"user: u\npassword: ${SECRET_TEST_UNSET}\n", "", true},
+		{"user: u\npassword: [a, b]\n", "", true},
+	}
+	for _, tt := range tests {
+		var s settings
+		err := yaml.Unmarshal([]byte(tt.in), &s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if s.Password != tt.want {
+			t.Errorf("Unmarshal(%q) password = %q, want %q", tt.in, string(s.Password), string(tt.want))
+		}
+
+		// The secret never shows in the encoded or printed settings.
+		out, err := yaml.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		printed := fmt.Sprintf("%v %+v", s, s)
+		for _, text := range []string{string(out), printed} {
+			if tt.want != "" && strings.Contains(text, string(tt.want)) {
+				t.Errorf("secret %q shows in %q", string(tt.want), text)
+			}
+			if tt.want != "" && !strings.Contains(text, Redacted) {
+				t.Errorf("%q is not marked as redacted", text)
+			}
+		}
+		if tt.want == "" && strings.Contains(string(out), "password") {
+			t.Errorf("unset secret encoded as %q, want it left out", out)
+		}
+	}
+}